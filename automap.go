@@ -0,0 +1,578 @@
+/*
+ * automap.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+)
+
+//Covalent radii, in A, used to find the bonds in a geometry (Cordero et al., Dalton Trans. 2008, 2832).
+//Elements not listed get the radius of carbon.
+var covalentRadii = map[string]float64{"H": 0.31, "B": 0.84, "C": 0.76, "N": 0.71, "O": 0.66, "F": 0.57, "Si": 1.11, "P": 1.07, "S": 1.05, "Cl": 1.02, "Se": 1.20, "Br": 1.20, "I": 1.39}
+
+//Two atoms are bonded if their distance is not larger than the sum of their covalent radii plus this tolerance, in A.
+const bondTolerance = 0.45
+
+//The number of heavy atoms Bartender aims for in the beads of chains, and the maximum for any bead.
+const mapChainSize = 4
+const mapMaxSize = 5
+
+func covalentRadius(symbol string) float64 {
+	r, ok := covalentRadii[symbol]
+	if !ok {
+		return covalentRadii["C"]
+	}
+	return r
+}
+
+//InferBonds returns, for each atom in mol, the indexes of the atoms bonded to it, according to their distances in coord.
+//Each hydrogen is bonded only to its nearest atom.
+func InferBonds(coord *v3.Matrix, mol chem.Atomer) [][]int {
+	n := mol.Len()
+	ret := make([][]int, n)
+	pos := func(i int) [3]float64 {
+		return [3]float64{coord.At(i, 0), coord.At(i, 1), coord.At(i, 2)}
+	}
+	bonded := func(i, j int) bool {
+		r := covalentRadius(mol.Atom(i).Symbol) + covalentRadius(mol.Atom(j).Symbol) + bondTolerance
+		return sqDist(pos(i), pos(j)) <= r*r
+	}
+	for i := 0; i < n; i++ {
+		if mol.Atom(i).Symbol == "H" {
+			continue
+		}
+		for j := i + 1; j < n; j++ {
+			if mol.Atom(j).Symbol != "H" && bonded(i, j) {
+				ret[i] = append(ret[i], j)
+				ret[j] = append(ret[j], i)
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		if mol.Atom(i).Symbol != "H" {
+			continue
+		}
+		nearest, d := -1, math.Inf(1)
+		for j := 0; j < n; j++ {
+			if j != i && sqDist(pos(i), pos(j)) < d {
+				nearest, d = j, sqDist(pos(i), pos(j))
+			}
+		}
+		if nearest >= 0 && bonded(i, nearest) {
+			ret[i] = append(ret[i], nearest)
+			ret[nearest] = append(ret[nearest], i)
+		}
+	}
+	return ret
+}
+
+//Rings returns the smallest ring containing each ring bond of the graph adj (see InferBonds) restricted to the atoms for which
+//use is true, each as its atoms, in order along the ring. Each ring is returned only once.
+func Rings(adj [][]int, use []bool) [][]int {
+	//the shortest path from a to b that doesn't use the bond a-b, if any.
+	path := func(a, b int) []int {
+		prev := map[int]int{a: -1}
+		queue := []int{a}
+		for len(queue) > 0 {
+			c := queue[0]
+			queue = queue[1:]
+			for _, v := range adj[c] {
+				if !use[v] || (c == a && v == b) {
+					continue
+				}
+				if _, ok := prev[v]; ok {
+					continue
+				}
+				prev[v] = c
+				if v == b {
+					ret := []int{}
+					for w := b; w != -1; w = prev[w] {
+						ret = append(ret, w)
+					}
+					return ret
+				}
+				queue = append(queue, v)
+			}
+		}
+		return nil
+	}
+	seen := make(map[string]bool)
+	ret := make([][]int, 0)
+	for a, v := range adj {
+		if !use[a] {
+			continue
+		}
+		for _, b := range v {
+			if b < a || !use[b] {
+				continue
+			}
+			ring := path(a, b)
+			if ring == nil {
+				continue
+			}
+			sorted := append([]int{}, ring...)
+			sort.Ints(sorted)
+			key := fmt.Sprint(sorted)
+			if !seen[key] {
+				seen[key] = true
+				ret = append(ret, ring)
+			}
+		}
+	}
+	return ret
+}
+
+//AutoMap suggests a mapping for mol, with the geometry coord, following the Martini 3 rules. Ring atoms are split into beads of 2 heavy atoms
+//(an atom left over is shared between two neighboring beads, with half weight in each), and the other heavy atoms into beads of 2 to 5 atoms,
+//aiming for 4. Each hydrogen goes to the bead (or beads) of its heavy atom. It returns the atoms in each bead, with their weights, as
+//ParseInputBead, and the bonds between the atoms (see InferBonds).
+func AutoMap(coord *v3.Matrix, mol chem.Atomer) ([][]int, [][]float64, [][]int) {
+	adj := InferBonds(coord, mol)
+	heavy := make([]bool, mol.Len())
+	for i := range heavy {
+		heavy[i] = mol.Atom(i).Symbol != "H"
+	}
+	inring := make([]bool, mol.Len())
+	ringbond := make(map[[2]int]bool)
+	for _, r := range Rings(adj, heavy) {
+		for i, v := range r {
+			inring[v] = true
+			w := r[(i+1)%len(r)]
+			ringbond[[2]int{v, w}] = true
+			ringbond[[2]int{w, v}] = true
+		}
+	}
+	var beads [][]int
+	var weights [][]float64
+	beadof := make(map[int][]int) //heavy atom -> the beads that contain it
+	addBead := func(atoms []int, w []float64) {
+		for _, v := range atoms {
+			beadof[v] = append(beadof[v], len(beads))
+		}
+		beads = append(beads, atoms)
+		weights = append(weights, w)
+	}
+	addAtom := func(bead, atom int, w float64) {
+		beads[bead] = append(beads[bead], atom)
+		weights[bead] = append(weights[bead], w)
+		beadof[atom] = append(beadof[atom], bead)
+	}
+	//Rings: pairs of bonded ring atoms. The atoms with the fewest free partners are paired first.
+	free := func(a int) []int {
+		ret := []int{}
+		for _, v := range adj[a] {
+			if ringbond[[2]int{a, v}] && len(beadof[v]) == 0 {
+				ret = append(ret, v)
+			}
+		}
+		return ret
+	}
+	for {
+		best := -1
+		for i, r := range inring {
+			if r && len(beadof[i]) == 0 && len(free(i)) > 0 && (best < 0 || len(free(i)) < len(free(best))) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		partners := free(best)
+		partner := partners[0]
+		for _, v := range partners[1:] {
+			if len(free(v)) < len(free(partner)) {
+				partner = v
+			}
+		}
+		addBead([]int{best, partner}, []float64{1, 1})
+	}
+	//The ring atoms left are shared between the (at most two) smallest neighboring ring beads.
+	for i, r := range inring {
+		if !r || len(beadof[i]) > 0 {
+			continue
+		}
+		var neighbors []int
+		for _, v := range adj[i] {
+			if ringbond[[2]int{i, v}] {
+				for _, b := range beadof[v] {
+					if !containsInt(neighbors, b) {
+						neighbors = append(neighbors, b)
+					}
+				}
+			}
+		}
+		sort.SliceStable(neighbors, func(a, b int) bool { return len(beads[neighbors[a]]) < len(beads[neighbors[b]]) })
+		switch len(neighbors) {
+		case 0:
+			addBead([]int{i}, []float64{1})
+		case 1:
+			addAtom(neighbors[0], i, 1)
+		default:
+			addAtom(neighbors[0], i, 0.5)
+			addAtom(neighbors[1], i, 0.5)
+		}
+	}
+	//Chains: the heavy atoms not in rings.
+	pool := make(map[int]bool)
+	for i, h := range heavy {
+		if h && !inring[i] {
+			pool[i] = true
+		}
+	}
+	var singles []int
+	for _, comp := range components(adj, pool) {
+		for _, g := range splitChain(adj, comp) {
+			if len(g) == 1 {
+				singles = append(singles, g[0])
+				continue
+			}
+			addBead(g, ones(len(g)))
+		}
+	}
+	//Lone heavy atoms join the smallest neighboring bead with room for them.
+	for _, a := range singles {
+		target := -1
+		for _, v := range adj[a] {
+			for _, b := range beadof[v] {
+				if heavyCount(beads[b], mol) < mapMaxSize && (target < 0 || len(beads[b]) < len(beads[target])) {
+					target = b
+				}
+			}
+		}
+		if target < 0 {
+			addBead([]int{a}, []float64{1})
+			continue
+		}
+		addAtom(target, a, 1)
+	}
+	//Hydrogens
+	for i, h := range heavy {
+		if h {
+			continue
+		}
+		if len(adj[i]) == 0 || len(beadof[adj[i][0]]) == 0 {
+			LogV(0, fmt.Sprintf("Hydrogen %d is not bonded to any heavy atom, and was not mapped", i+1))
+			continue
+		}
+		owners := beadof[adj[i][0]]
+		for _, b := range owners {
+			addAtom(b, i, 1/float64(len(owners)))
+		}
+	}
+	//The beads are sorted by their first atom, and their atoms, by index.
+	order := make([]int, len(beads))
+	for i := range order {
+		order[i] = i
+		sortAtoms(beads[i], weights[i])
+	}
+	sort.Slice(order, func(a, b int) bool { return beads[order[a]][0] < beads[order[b]][0] })
+	sb := make([][]int, len(beads))
+	sw := make([][]float64, len(beads))
+	for i, v := range order {
+		sb[i], sw[i] = beads[v], weights[v]
+	}
+	return sb, sw, adj
+}
+
+//components returns the connected components of the graph adj restricted to the atoms in pool.
+func components(adj [][]int, pool map[int]bool) [][]int {
+	seen := make(map[int]bool)
+	keys := make([]int, 0, len(pool))
+	for k := range pool {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	ret := make([][]int, 0)
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		comp := []int{k}
+		for i := 0; i < len(comp); i++ {
+			for _, v := range adj[comp[i]] {
+				if pool[v] && !seen[v] {
+					seen[v] = true
+					comp = append(comp, v)
+				}
+			}
+		}
+		ret = append(ret, comp)
+	}
+	return ret
+}
+
+//splitChain splits the connected atoms in comp into groups of about mapChainSize atoms. Groups are grown from the
+//end of the chain, and the atoms left are split again. Groups of only one atom can be returned.
+func splitChain(adj [][]int, comp []int) [][]int {
+	n := len(comp)
+	if n <= mapMaxSize {
+		return [][]int{comp}
+	}
+	nbeads := int(math.Round(float64(n) / mapChainSize))
+	size := int(math.Ceil(float64(n) / float64(nbeads)))
+	pool := make(map[int]bool)
+	for _, v := range comp {
+		pool[v] = true
+	}
+	//an end of the chain: the atom farthest from any other one.
+	bfs := func(start int) []int {
+		seen := map[int]bool{start: true}
+		order := []int{start}
+		for i := 0; i < len(order); i++ {
+			for _, v := range adj[order[i]] {
+				if pool[v] && !seen[v] {
+					seen[v] = true
+					order = append(order, v)
+				}
+			}
+		}
+		return order
+	}
+	far := bfs(comp[0])
+	group := bfs(far[len(far)-1])[:size]
+	for _, v := range group {
+		delete(pool, v)
+	}
+	ret := [][]int{group}
+	for _, c := range components(adj, pool) {
+		ret = append(ret, splitChain(adj, c)...)
+	}
+	return ret
+}
+
+func ones(n int) []float64 {
+	ret := make([]float64, n)
+	for i := range ret {
+		ret[i] = 1
+	}
+	return ret
+}
+
+func heavyCount(atoms []int, mol chem.Atomer) int {
+	ret := 0
+	for _, v := range atoms {
+		if mol.Atom(v).Symbol != "H" {
+			ret++
+		}
+	}
+	return ret
+}
+
+//sortAtoms sorts the atoms of a bead by index, keeping each weight with its atom.
+func sortAtoms(atoms []int, weights []float64) {
+	sort.Sort(beadAtoms{atoms, weights})
+}
+
+type beadAtoms struct {
+	atoms   []int
+	weights []float64
+}
+
+func (b beadAtoms) Len() int           { return len(b.atoms) }
+func (b beadAtoms) Less(i, j int) bool { return b.atoms[i] < b.atoms[j] }
+func (b beadAtoms) Swap(i, j int) {
+	b.atoms[i], b.atoms[j] = b.atoms[j], b.atoms[i]
+	b.weights[i], b.weights[j] = b.weights[j], b.weights[i]
+}
+
+//BeadTopology returns the bonds, angles and dihedrals between the given beads. Two beads are bonded if they share
+//an atom, or if any of their atoms are bonded (according to adj, see InferBonds).
+func BeadTopology(beads [][]int, adj [][]int) map[string][][]int {
+	n := len(beads)
+	bonded := make([][]bool, n)
+	for i := range bonded {
+		bonded[i] = make([]bool, n)
+	}
+	ret := map[string][][]int{"bonds": nil, "angles": nil, "dihe": nil}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+		search:
+			for _, a := range beads[i] {
+				for _, b := range beads[j] {
+					if a == b || containsInt(adj[a], b) {
+						bonded[i][j], bonded[j][i] = true, true
+						ret["bonds"] = append(ret["bonds"], []int{i, j})
+						break search
+					}
+				}
+			}
+		}
+	}
+	neighbors := func(i int) []int {
+		ret := []int{}
+		for j, b := range bonded[i] {
+			if b {
+				ret = append(ret, j)
+			}
+		}
+		return ret
+	}
+	for j := 0; j < n; j++ {
+		nj := neighbors(j)
+		for a := range nj {
+			for b := a + 1; b < len(nj); b++ {
+				ret["angles"] = append(ret["angles"], []int{nj[a], j, nj[b]})
+			}
+		}
+	}
+	for _, v := range ret["bonds"] {
+		j, k := v[0], v[1]
+		for _, i := range neighbors(j) {
+			for _, l := range neighbors(k) {
+				if i != k && l != j && i != l {
+					ret["dihe"] = append(ret["dihe"], []int{i, j, k, l})
+				}
+			}
+		}
+	}
+	return ret
+}
+
+//WriteInput writes a Bartender input file, outname, with the given beads, weights and interactions (see BeadTopology).
+//The lines in header are written as comments at the beginning of the file.
+func WriteInput(outname string, beads [][]int, weights [][]float64, interactions map[string][][]int, header []string) error {
+	fout, err := os.Create(outname)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	for _, v := range header {
+		fout.WriteString("#" + v + "\n")
+	}
+	fout.WriteString("BEADS\n")
+	for i, v := range beads {
+		atoms := make([]string, 0, len(v))
+		for j, a := range v {
+			if weights[i][j] == 0 {
+				continue //the format has no way to include atoms that don't contribute to the bead, and they don't change it.
+			}
+			atom := strconv.Itoa(a + 1)
+			if weights[i][j] != 1 {
+				atom += "/" + strconv.FormatFloat(1/weights[i][j], 'g', 4, 64)
+			}
+			atoms = append(atoms, atom)
+		}
+		fout.WriteString(fmt.Sprintf("%d %s\n", i+1, strings.Join(atoms, ",")))
+	}
+	for _, k := range []string{"bonds", "angles", "dihe"} {
+		fout.WriteString(map[string]string{"bonds": "BONDS", "angles": "ANGLES", "dihe": "DIHEDRALS"}[k] + "\n")
+		for _, v := range interactions[k] {
+			str := make([]string, len(v))
+			for j, b := range v {
+				str[j] = strconv.Itoa(b + 1)
+			}
+			fout.WriteString(strings.Join(str, ",") + "\n")
+		}
+	}
+	return nil
+}
+
+//MapMain suggests a mapping for the molecule in the geometry given in args, and writes it as a Bartender input file,
+//ready to be edited. The beads are also written to Beads.pdb, so they can be checked visually.
+func MapMain(args []string) {
+	fs := flag.NewFlagSet("map", flag.ExitOnError)
+	outname := fs.String("o", "mapping.inp", "The Bartender input file written")
+	from := fs.String("from", "", "Take the mapping from this file (a Bartender input file, or a backward .map or vermouth .mapping file) instead of suggesting one. The Bartender input file is only written if this one is not a Bartender input file")
+	backward := fs.String("backward", "", "Also write the mapping to this file, in the backward format")
+	vermouth := fs.String("vermouth", "", "Also write the mapping to this file, in the vermouth/martinize2 format")
+	verbose := fs.Int("verbose", 0, "Print additional information")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  %s map [flags] geometry.pdb/.gro/.xyz\n\nSuggests a Martini 3-like mapping for the molecule, and writes it, with all the bonds, angles and dihedrals between the beads, as a Bartender input file.\nThe mapping can also be written in the backward and vermouth formats, and a mapping in any of these formats can be converted to the others.\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	verb = *verbose
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	mol, err := ReadGeometry(fs.Arg(0))
+	if err != nil {
+		panic(err.Error())
+	}
+	var beads [][]int
+	var weights [][]float64
+	var names []string
+	adj := InferBonds(mol.Coords[0], mol)
+	writeinp := true
+	switch {
+	case *from == "":
+		beads, weights, adj = AutoMap(mol.Coords[0], mol)
+	case isMappingFile(*from):
+		beads, weights, names, err = ReadMapping(*from, mol)
+		if err != nil {
+			panic(err.Error())
+		}
+	default:
+		beads, weights = ParseInputBead(*from)
+		writeinp = false
+	}
+	for _, v := range [][2]string{{*backward, "backward"}, {*vermouth, "vermouth"}} {
+		if v[0] == "" {
+			continue
+		}
+		if err := WriteMapping(v[0], v[1], mol, beads, weights, names); err != nil {
+			panic(err.Error())
+		}
+		fmt.Printf("Mapping written to %s in the %s format\n", v[0], v[1])
+	}
+	if !writeinp {
+		MakePDB(mol.Coords[0], mol, beads)
+		return
+	}
+	interactions := BeadTopology(beads, adj)
+	header := []string{
+		fmt.Sprintf("Mapping suggested by Bartender - www.github.com/rmera/bartender for %s", fs.Arg(0)),
+		"Please check it (for instance, with Beads.pdb) and edit it as needed before using it.",
+		"All the bonds, angles and dihedrals between the beads are included. You may want to remove some of them, or turn some into IMPROPERS.",
+	}
+	if *from != "" {
+		header[0] = fmt.Sprintf("Mapping from %s, by Bartender - www.github.com/rmera/bartender, for %s", *from, fs.Arg(0))
+	}
+	for i, v := range names {
+		header = append(header, fmt.Sprintf("Bead %d is %s in %s", i+1, v, *from))
+	}
+	header = append(header, "Suggested Martini 3 bead types:")
+	for _, v := range SuggestBeadTypes(mol.Coords[0], mol, beads, weights, nil) {
+		header = append(header, fmt.Sprintf("Bead %d: %s", v.bead+1, v.Text()))
+	}
+	if err := WriteInput(*outname, beads, weights, interactions, header); err != nil {
+		panic(err.Error())
+	}
+	MakePDB(mol.Coords[0], mol, beads)
+	fmt.Printf("%d beads, %d bonds, %d angles and %d dihedrals written to %s\n", len(beads), len(interactions["bonds"]), len(interactions["angles"]), len(interactions["dihe"]), *outname)
+}
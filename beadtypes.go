@@ -0,0 +1,537 @@
+/*
+ * beadtypes.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/floats"
+)
+
+//The standard masses, in amu, of the Martini 3 beads of each size.
+var martiniMasses = map[string]float64{"R": 72, "S": 54, "T": 36}
+
+//A chemical fragment and the Martini 3 bead type for it, with the charge of the fragment and the confidence of the assignment.
+//Most types are those used for the same fragments in the Martini 3 models of amino acids, lipids and small molecules.
+type martiniFragment struct {
+	group      string
+	bead       string
+	charge     float64
+	confidence string
+}
+
+//The fragments, in order of priority: if a bead contains several, the first one in this list sets its type.
+var martiniFragments = []martiniFragment{
+	{"guanidinium", "Q3p", 1, "high"},
+	{"ammonium", "Q4p", 1, "high"},
+	{"carboxylate", "Q5n", -1, "high"},
+	{"phosphate", "Q5", -1, "medium"},
+	{"sulfonate", "Q4n", -1, "low"},
+	{"amide", "P5", 0, "high"},
+	{"carboxylic acid", "P2", 0, "high"},
+	{"alcohol", "P1", 0, "high"},
+	{"phenol", "N6", 0, "high"},
+	{"amine", "N6d", 0, "medium"},
+	{"aromatic NH", "N6d", 0, "high"},
+	{"aromatic N", "N6a", 0, "high"},
+	{"nitrile", "N6a", 0, "low"},
+	{"nitro", "N4a", 0, "low"},
+	{"aldehyde", "N5a", 0, "medium"},
+	{"ketone", "N5a", 0, "medium"},
+	{"ester", "N4a", 0, "medium"},
+	{"ether", "N3a", 0, "low"},
+	{"thiol", "C6", 0, "high"},
+	{"thiophene", "C6", 0, "medium"},
+	{"thioether", "C6", 0, "high"},
+	{"iodo", "X1", 0, "low"},
+	{"bromo", "X2", 0, "low"},
+	{"chloro", "X3", 0, "low"},
+	{"fluoro", "X4", 0, "low"},
+	{"fused aromatic", "C4", 0, "medium"},
+	{"aromatic", "C5", 0, "high"},
+	{"alkene", "C4", 0, "high"},
+	{"alkyne", "C4", 0, "medium"},
+	{"alkane", "C1", 0, "high"},
+}
+
+//The groups containing only carbons and hydrogens.
+var hydrocarbonGroups = map[string]bool{"fused aromatic": true, "aromatic": true, "alkene": true, "alkyne": true, "alkane": true}
+
+//The types used for hydrocarbon beads of each size, when they differ from the regular ones.
+var alkaneTypes = map[string]string{"R": "C1", "S": "C3", "T": "C3"}
+
+//The confidence levels, from the highest.
+var confidenceLevels = []string{"high", "medium", "low"}
+
+//BeadType is the Martini 3 bead type suggested for a bead.
+type BeadType struct {
+	bead       int    //0-based
+	size       string //R, S or T
+	name       string //the type, without the size prefix
+	groups     []string
+	confidence string
+	virtual    bool
+	residue    string
+	charge     float64
+}
+
+//Type returns the full name of the bead type, including the size prefix.
+func (b *BeadType) Type() string {
+	if b.size == "R" {
+		return b.name
+	}
+	return b.size + b.name
+}
+
+//Mass returns the standard Martini 3 mass for the bead, or 0 for virtual sites.
+func (b *BeadType) Mass() float64 {
+	if b.virtual {
+		return 0
+	}
+	return martiniMasses[b.size]
+}
+
+//Charge returns the charge of the bead.
+func (b *BeadType) Charge() float64 {
+	return b.charge
+}
+
+//Text returns a description of the suggestion, with its confidence and the fragments found.
+func (b *BeadType) Text() string {
+	return fmt.Sprintf("%s (confidence: %s; %s)", b.Type(), b.confidence, strings.Join(b.groups, ", "))
+}
+
+//molGraph has the information on the atomistic molecule needed to identify the fragments in each bead.
+type molGraph struct {
+	mol   chem.Atomer
+	coord *v3.Matrix
+	adj   [][]int
+	rings [][]int
+}
+
+func (g *molGraph) symbol(i int) string {
+	return g.mol.Atom(i).Symbol
+}
+
+//hydrogens returns the number of hydrogens bonded to the atom i.
+func (g *molGraph) hydrogens(i int) int {
+	ret := 0
+	for _, v := range g.adj[i] {
+		if g.symbol(v) == "H" {
+			ret++
+		}
+	}
+	return ret
+}
+
+//heavyNeighbors returns the heavy atoms bonded to the atom i.
+func (g *molGraph) heavyNeighbors(i int) []int {
+	ret := []int{}
+	for _, v := range g.adj[i] {
+		if g.symbol(v) != "H" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+//chargeCenter returns the center of the charged group gr that contains the atom i: the atom, among i and its heavy neighbors,
+//bonded to most atoms of the group (say, the carbon of a carboxylate), or the one with the lowest index, in case of a tie.
+func (g *molGraph) chargeCenter(i int, gr string) int {
+	best, most := i, -1
+	for _, c := range append([]int{i}, g.heavyNeighbors(i)...) {
+		n := 0
+		for _, v := range g.heavyNeighbors(c) {
+			if g.Group(v) == gr {
+				n++
+			}
+		}
+		if n > most || (n == most && c < best) {
+			best, most = c, n
+		}
+	}
+	return best
+}
+
+//bondOrder estimates the order of the bond between the atoms i and j from its length: 1, 1.5 (aromatic), 2 or 3.
+func (g *molGraph) bondOrder(i, j int) float64 {
+	pair := []string{g.symbol(i), g.symbol(j)}
+	sort.Strings(pair)
+	d := distance(g.coord.VecView(i), g.coord.VecView(j), v3.Zeros(1)) * 10 //distance returns nm
+	//the largest lengths, in A, for triple, double and aromatic bonds between each pair of elements.
+	limits := map[string][3]float64{
+		"C-C": {1.25, 1.36, 1.44},
+		"C-N": {1.20, 1.31, 1.40},
+		"C-O": {0, 1.30, 0},
+		"C-S": {0, 1.65, 1.76},
+		"N-O": {0, 1.26, 0},
+		"N-N": {0, 1.28, 1.38},
+		"O-S": {0, 1.50, 0},
+		"O-P": {0, 1.52, 0},
+	}
+	l, ok := limits[pair[0]+"-"+pair[1]]
+	switch {
+	case !ok:
+		return 1
+	case d <= l[0]:
+		return 3
+	case d <= l[1]:
+		return 2
+	case d <= l[2]:
+		return 1.5
+	}
+	return 1
+}
+
+//aromatic returns true if the atom i belongs to a ring of 5 or 6 atoms with at most 3 neighbors each, and either all the carbons
+//with 3 neighbors, or all the bonds aromatic or double, according to their lengths (for geometries without hydrogens).
+//If fused is given, it is set to true if the atom belongs to more than one such ring.
+func (g *molGraph) aromatic(i int, fused *bool) bool {
+	n := 0
+	for _, r := range g.rings {
+		if (len(r) != 5 && len(r) != 6) || !containsInt(r, i) {
+			continue
+		}
+		sp2, conjugated := true, true
+		for j, v := range r {
+			k := len(g.adj[v])
+			if k > 3 {
+				sp2, conjugated = false, false
+			}
+			if g.symbol(v) == "C" && k != 3 {
+				sp2 = false
+			}
+			if g.bondOrder(v, r[(j+1)%len(r)]) < 1.5 {
+				conjugated = false
+			}
+		}
+		if sp2 || conjugated {
+			n++
+		}
+	}
+	if fused != nil {
+		*fused = n > 1
+	}
+	return n > 0
+}
+
+//carbonyl returns true if the carbon i has a double bond to an oxygen.
+func (g *molGraph) carbonyl(i int) bool {
+	if g.symbol(i) != "C" {
+		return false
+	}
+	for _, v := range g.heavyNeighbors(i) {
+		if g.symbol(v) == "O" && len(g.adj[v]) == 1 && g.bondOrder(i, v) >= 2 {
+			return true
+		}
+	}
+	return false
+}
+
+//Group returns the name of the functional group (as in martiniFragments) to which the heavy atom i belongs.
+func (g *molGraph) Group(i int) string {
+	h := g.hydrogens(i)
+	heavy := g.heavyNeighbors(i)
+	count := func(el string) int {
+		ret := 0
+		for _, v := range heavy {
+			if g.symbol(v) == el {
+				ret++
+			}
+		}
+		return ret
+	}
+	switch g.symbol(i) {
+	case "O":
+		if len(heavy) == 0 {
+			return "alcohol" //water, really.
+		}
+		c := heavy[0]
+		switch {
+		case g.symbol(c) == "P":
+			return "phosphate"
+		case g.symbol(c) == "S" && len(heavy) == 1:
+			return "sulfonate"
+		case g.symbol(c) == "N" && len(heavy) == 1:
+			return "nitro"
+		case len(heavy) == 2:
+			for _, v := range heavy {
+				if g.carbonyl(v) {
+					return "ester"
+				}
+				if g.symbol(v) == "P" {
+					return "phosphate"
+				}
+			}
+			return "ether"
+		case h > 0 && g.carbonyl(c):
+			return "carboxylic acid"
+		case h > 0 && g.aromatic(c, nil):
+			return "phenol"
+		case h > 0 || g.bondOrder(i, c) < 2:
+			return "alcohol" //without the bond order check, alcohols in geometries without hydrogens would be taken as carbonyls.
+		}
+		return g.carbonylGroup(c)
+	case "N":
+		for _, v := range heavy {
+			if g.symbol(v) == "C" && len(g.heavyNeighbors(v)) == 3 && len(g.adj[v]) == 3 {
+				nitrogens := 0
+				for _, w := range g.heavyNeighbors(v) {
+					if g.symbol(w) == "N" {
+						nitrogens++
+					}
+				}
+				if nitrogens == 3 {
+					return "guanidinium"
+				}
+			}
+		}
+		switch {
+		case count("O") >= 2:
+			return "nitro"
+		case len(g.adj[i]) == 4:
+			return "ammonium"
+		case len(heavy) == 1 && g.bondOrder(i, heavy[0]) == 3:
+			return "nitrile"
+		case g.aromatic(i, nil) && h > 0:
+			return "aromatic NH"
+		case g.aromatic(i, nil):
+			return "aromatic N"
+		}
+		for _, v := range heavy {
+			if g.carbonyl(v) {
+				return "amide"
+			}
+		}
+		return "amine"
+	case "S":
+		switch {
+		case count("O") >= 2:
+			return "sulfonate"
+		case h > 0:
+			return "thiol"
+		case g.aromatic(i, nil):
+			return "thiophene"
+		}
+		return "thioether"
+	case "P":
+		return "phosphate"
+	case "F":
+		return "fluoro"
+	case "Cl":
+		return "chloro"
+	case "Br":
+		return "bromo"
+	case "I":
+		return "iodo"
+	}
+	//Carbons, and anything else.
+	fused := false
+	if g.aromatic(i, &fused) {
+		if fused {
+			return "fused aromatic"
+		}
+		return "aromatic"
+	}
+	if g.carbonyl(i) {
+		return g.carbonylGroup(i)
+	}
+	for _, v := range heavy {
+		switch g.bondOrder(i, v) {
+		case 3:
+			if g.symbol(v) == "N" {
+				return "nitrile"
+			}
+			return "alkyne"
+		case 2, 1.5:
+			return "alkene"
+		}
+	}
+	return "alkane"
+}
+
+//carbonylGroup returns the group to which the carbonyl carbon c belongs.
+func (g *molGraph) carbonylGroup(c int) string {
+	oxygens, nitrogens := 0, 0
+	protonated := false
+	for _, v := range g.heavyNeighbors(c) {
+		switch g.symbol(v) {
+		case "O":
+			oxygens++
+			if g.hydrogens(v) > 0 {
+				protonated = true
+			} else if len(g.heavyNeighbors(v)) == 2 {
+				return "ester"
+			}
+		case "N":
+			nitrogens++
+		}
+	}
+	switch {
+	case nitrogens > 0:
+		return "amide"
+	case oxygens >= 2 && protonated:
+		return "carboxylic acid"
+	case oxygens >= 2:
+		return "carboxylate"
+	case g.hydrogens(c) > 0:
+		return "aldehyde"
+	}
+	return "ketone"
+}
+
+//SuggestBeadTypes suggests a Martini 3 type for each of the beads given by indexes and weights, from the fragment of mol,
+//with the geometry coord, that the bead contains. The bead size is obtained from its number of heavy atoms (see BeadSize).
+//The confidence of each suggestion is lowered if the bead contains several different polar groups, or only carbons
+//of different kinds (say, aromatic and non-aromatic). The virtual sites in vs get no mass. The charge of each charged group
+//goes to only one bead, the one with the largest weight of its atoms, so groups split among, or shared by, beads are counted once.
+func SuggestBeadTypes(coord *v3.Matrix, mol chem.Atomer, indexes [][]int, weights [][]float64, vs []*VirtualSite) []*BeadType {
+	heavy := make([]bool, mol.Len())
+	for i := range heavy {
+		heavy[i] = mol.Atom(i).Symbol != "H"
+	}
+	adj := InferBonds(coord, mol)
+	g := &molGraph{mol: mol, coord: coord, adj: adj, rings: Rings(adj, heavy)}
+	priority := make(map[string]int)
+	for i, v := range martiniFragments {
+		priority[v.group] = i
+	}
+	ret := make([]*BeadType, len(indexes))
+	for i, v := range indexes {
+		t := &BeadType{bead: i, size: BeadSize(mol, v, weights[i]), residue: mol.Atom(v[0]).Molname}
+		if t.residue == "" {
+			t.residue = "MOL"
+		}
+		for _, w := range vs {
+			if w.bead == i {
+				t.virtual = true
+			}
+		}
+		for _, a := range v {
+			if !heavy[a] {
+				continue
+			}
+			if gr := g.Group(a); !containsString(t.groups, gr) {
+				t.groups = append(t.groups, gr)
+			}
+		}
+		ret[i] = t
+		if len(t.groups) == 0 {
+			t.name, t.confidence, t.groups = "C1", "low", []string{"no heavy atoms"}
+			continue
+		}
+		sort.Slice(t.groups, func(a, b int) bool { return priority[t.groups[a]] < priority[t.groups[b]] })
+		f := martiniFragments[priority[t.groups[0]]]
+		t.name, t.confidence = f.bead, f.confidence
+		if f.group == "alkane" {
+			t.name = alkaneTypes[t.size]
+			if t.size != "R" {
+				t.confidence = "medium"
+			}
+		}
+		polar := 0
+		for _, gr := range t.groups {
+			if !hydrocarbonGroups[gr] {
+				polar++
+			}
+		}
+		switch {
+		case polar > 1:
+			t.confidence = "low"
+		case len(t.groups) > 1 && polar == 0:
+			t.confidence = lowerConfidence(t.confidence)
+		}
+	}
+	chargeBeads(g, ret, indexes, weights)
+	return ret
+}
+
+//chargeBeads sets the charges of the beads with the types given, the atoms in indexes and the weights given. The charge of each
+//charged group in g goes to the bead with the largest weight of its atoms.
+func chargeBeads(g *molGraph, types []*BeadType, indexes [][]int, weights [][]float64) {
+	charges := make(map[string]float64)
+	for _, f := range martiniFragments {
+		if f.charge != 0 {
+			charges[f.group] = f.charge
+		}
+	}
+	type instance struct {
+		group  string
+		center int
+	}
+	beadw := make(map[instance][]float64) //the weight of the atoms of each charged group in each bead.
+	order := make([]instance, 0, 2)
+	for i, v := range indexes {
+		for j, a := range v {
+			if g.symbol(a) == "H" {
+				continue
+			}
+			gr := g.Group(a)
+			if charges[gr] == 0 {
+				continue
+			}
+			in := instance{gr, g.chargeCenter(a, gr)}
+			if _, ok := beadw[in]; !ok {
+				beadw[in] = make([]float64, len(indexes))
+				order = append(order, in)
+			}
+			beadw[in][i] += weights[i][j]
+		}
+	}
+	for _, t := range types {
+		t.charge = 0
+	}
+	for _, in := range order {
+		types[floats.MaxIdx(beadw[in])].charge += charges[in.group]
+	}
+}
+
+//CheckBeadCharges warns if the sum of the charges of the beads with the types given differs from charge, the total charge of the molecule.
+func CheckBeadCharges(types []*BeadType, charge int) {
+	total := 0.0
+	for _, v := range types {
+		total += v.Charge()
+	}
+	if math.Abs(total-float64(charge)) > 1e-6 {
+		LogV(0, fmt.Sprintf("The charges of the beads add up to %.1f, but the charge of the molecule is %d. Please check the charges in the atoms section", total, charge))
+	}
+}
+
+//lowerConfidence returns the confidence level below c.
+func lowerConfidence(c string) string {
+	for i, v := range confidenceLevels[:len(confidenceLevels)-1] {
+		if v == c {
+			return confidenceLevels[i+1]
+		}
+	}
+	return c
+}
@@ -0,0 +1,416 @@
+/*
+ * compare.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+//The categories in which the interactions of itp files are compared, in the order they are reported.
+var compareCategories = []string{"bonds", "angles", "dihedrals", "impropers"}
+
+//ITPEntry is one bonded interaction read from a GROMACS itp file.
+type ITPEntry struct {
+	category   string //one of compareCategories
+	beads      []int  //1-based, as in the itp
+	functype   int
+	params     []float64
+	constraint bool    //read from the [constraints] section, so it has no force constant
+	rmsd       float64 //the RMSD of the fit, for itps written by Bartender, NaN otherwise
+}
+
+//key returns a string identifying the interaction by its category and beads. The beads
+//can be given in either direction.
+func (e *ITPEntry) key() string {
+	b := e.beads
+	rev := false
+	for i := range b {
+		if b[i] != b[len(b)-1-i] {
+			rev = b[len(b)-1-i] < b[i]
+			break
+		}
+	}
+	ret := e.category
+	for i := range b {
+		if rev {
+			ret += " " + strconv.Itoa(b[len(b)-1-i])
+		} else {
+			ret += " " + strconv.Itoa(b[i])
+		}
+	}
+	return ret
+}
+
+//potential returns the Bartender potential with the function type of the entry, or nil if there is none.
+func (e *ITPEntry) potential() Potential {
+	switch e.category {
+	case "bonds":
+		return PotentialFor("bonds", e.functype)
+	case "angles":
+		if p := PotentialFor("angles", e.functype); p != nil {
+			return p
+		}
+		return PotentialFor("reb", e.functype)
+	case "dihedrals":
+		if e.functype == 9 {
+			return PotentialFor("dihe", 1) //multiple terms, each like the simple periodic one.
+		}
+		return PotentialFor("dihe", e.functype)
+	}
+	if e.functype == 4 {
+		return PotentialFor("dihe", 1) //periodic improper
+	}
+	return PotentialFor("improp", e.functype)
+}
+
+//parameter returns the name and unit of the ith parameter of the entry, using those of the Bartender potential,
+//if there is one.
+func (e *ITPEntry) parameter(i int) (string, string) {
+	if p := e.potential(); p != nil && i < len(p.ParNames()) {
+		return p.ParNames()[i], p.ParUnits()[i]
+	}
+	if i == 0 && (e.category == "bonds" || e.category == "angles") {
+		//the equilibrium value is the first parameter for the most common function types.
+		if e.category == "bonds" {
+			return "eq", "nm"
+		}
+		return "eq", "deg"
+	}
+	return fmt.Sprintf("p%d", i+1), ""
+}
+
+//ReadITP reads the bonds, constraints, angles and dihedrals in the GROMACS itp file name. Any itp can be read, not only
+//those written by Bartender. Commented lines are ignored, as are the preprocessor directives and the other sections.
+//Interactions whose parameters are not given as numbers (for instance, those taken from the force field, or given as macros)
+//are reported and skipped. Dihedrals with function types 2 and 4 are read as impropers.
+func ReadITP(name string) ([]*ITPEntry, error) {
+	fin, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	nbeads := map[string]int{"bonds": 2, "constraints": 2, "angles": 3, "dihedrals": 4}
+	ret := make([]*ITPEntry, 0, 20)
+	section := ""
+	scanner := bufio.NewScanner(fin)
+	for l := 1; scanner.Scan(); l++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.TrimSpace(strings.Trim(line, "[]")))
+			continue
+		}
+		n, ok := nbeads[section]
+		if !ok {
+			continue
+		}
+		comment := ""
+		if i := strings.Index(line, ";"); i >= 0 {
+			line, comment = line[:i], line[i:]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < n+1 {
+			return nil, fmt.Errorf("%s, line %d: malformed %s entry", name, l, section)
+		}
+		e := &ITPEntry{category: section, beads: make([]int, n), rmsd: math.NaN()}
+		for i := range e.beads {
+			if e.beads[i], err = strconv.Atoi(fields[i]); err != nil {
+				return nil, fmt.Errorf("%s, line %d: %s", name, l, err.Error())
+			}
+		}
+		if e.functype, err = strconv.Atoi(fields[n]); err != nil {
+			return nil, fmt.Errorf("%s, line %d: %s", name, l, err.Error())
+		}
+		for _, v := range fields[n+1:] {
+			p, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				e.params = nil
+				break
+			}
+			e.params = append(e.params, p)
+		}
+		if len(e.params) == 0 {
+			LogV(1, fmt.Sprintf("%s, line %d: no numerical parameters, the interaction will not be compared", name, l))
+			continue
+		}
+		if section == "constraints" {
+			e.category, e.constraint = "bonds", true
+		}
+		if section == "dihedrals" && (e.functype == 2 || e.functype == 4) {
+			e.category = "impropers"
+		}
+		if i := strings.Index(comment, "rmsd:"); i >= 0 {
+			if f := strings.Fields(comment[i+len("rmsd:"):]); len(f) > 0 {
+				if r, err := strconv.ParseFloat(f[0], 64); err == nil {
+					e.rmsd = r
+				}
+			}
+		}
+		ret = append(ret, e)
+	}
+	return ret, scanner.Err()
+}
+
+//A deviation of a parameter of an interaction from its reference value.
+type deviation struct {
+	category string
+	beads    []int
+	param    string
+	unit     string
+	ref      float64
+	test     float64
+}
+
+//diff returns the deviation. Angles are compared as such, so the result is between -180 and 180 degrees.
+func (d *deviation) diff() float64 {
+	ret := d.test - d.ref
+	if d.unit == "deg" {
+		ret = math.Mod(math.Mod(ret+180, 360)+360, 360) - 180
+	}
+	return ret
+}
+
+//CompareITP matches the interactions in test to those in ref, by category and beads, and returns the deviations of their parameters.
+//When both interactions have the same function type, all the parameters are compared. Otherwise only the equilibrium values
+//are, if both have one. It also returns the number of interactions in ref without a match in test, and vice versa.
+//Only the first entry for each interaction (in case of several, as with GROMACS' function type 9) is considered.
+func CompareITP(ref, test []*ITPEntry) ([]*deviation, int, int) {
+	first := func(entries []*ITPEntry) (map[string]*ITPEntry, []string) {
+		m := make(map[string]*ITPEntry)
+		order := make([]string, 0, len(entries))
+		for _, v := range entries {
+			k := v.key()
+			if _, ok := m[k]; ok {
+				continue
+			}
+			m[k] = v
+			order = append(order, k)
+		}
+		return m, order
+	}
+	refmap, order := first(ref)
+	testmap, _ := first(test)
+	ret := make([]*deviation, 0, len(ref))
+	unmatched := 0
+	for _, k := range order {
+		r := refmap[k]
+		t, ok := testmap[k]
+		if !ok {
+			unmatched++
+			continue
+		}
+		n := 0
+		if r.functype == t.functype && r.constraint == t.constraint {
+			n = len(r.params)
+			if len(t.params) < n {
+				n = len(t.params)
+			}
+		} else if rn, _ := r.parameter(0); rn == "eq" {
+			if tn, _ := t.parameter(0); tn == "eq" {
+				n = 1
+			}
+		}
+		for i := 0; i < n; i++ {
+			name, unit := r.parameter(i)
+			ret = append(ret, &deviation{category: r.category, beads: r.beads, param: name, unit: unit, ref: r.params[i], test: t.params[i]})
+		}
+	}
+	return ret, unmatched, len(testmap) - (len(refmap) - unmatched)
+}
+
+//devStats returns the mean deviation, the mean absolute deviation, the root mean square deviation and the mean absolute
+//relative deviation (%, excluding references equal to zero) of devs.
+func devStats(devs []*deviation) (float64, float64, float64, float64) {
+	var mean, mad, rms, rel float64
+	nrel := 0
+	for _, v := range devs {
+		d := v.diff()
+		mean += d
+		mad += math.Abs(d)
+		rms += d * d
+		if v.ref != 0 {
+			rel += math.Abs(d / v.ref)
+			nrel++
+		}
+	}
+	n := float64(len(devs))
+	rel = 100 * rel / float64(nrel)
+	if nrel == 0 {
+		rel = math.NaN()
+	}
+	return mean / n, mad / n, math.Sqrt(rms / n), rel
+}
+
+//CompareMain runs the compare mode, with the command line arguments args: the parameters in one or more itp
+//files are compared to those in a reference itp. The deviations for each category of interactions and parameter are
+//printed, and written, for each interaction, to a tab-separated file. For each category and parameter, a box plot
+//of the deviations in each file is produced, as is one of the RMSDs of the fits, for itps written by Bartender.
+func CompareMain(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	outname := fs.String("o", "compare.tsv", "The tab-separated file where the deviation of each parameter of each interaction is written")
+	noplot := fs.Bool("noplot", false, "Do not produce the box plots")
+	verbose := fs.Int("verbose", 0, "Print additional information, such as the interactions that can't be compared")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  %s compare [flags] reference.itp test1.itp [test2.itp ...]\n\nCompares the parameters in the test itp files to those in the reference one, matching the interactions by their beads.\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	verb = *verbose
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	names := fs.Args()
+	entries := make([][]*ITPEntry, len(names))
+	for i, v := range names {
+		var err error
+		entries[i], err = ReadITP(v)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	fout, err := os.Create(*outname)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer fout.Close()
+	fout.WriteString(fmt.Sprintf("# Deviations from the parameters in %s, by Bartender - www.github.com/rmera/bartender\n", names[0]))
+	fout.WriteString("# file\tcategory\tbeads\tparameter\tunit\treference\tvalue\tdeviation\n")
+	//category -> parameter -> one slice of deviations per test file, for the plots
+	plotdata := make(map[string]map[string][][]float64)
+	paramorder := make(map[string][]string)
+	for i, name := range names[1:] {
+		devs, unmatched, extra := CompareITP(entries[0], entries[i+1])
+		fmt.Printf("\n%s vs %s: %d interactions without a match in %s, %d not in the reference\n", name, names[0], unmatched, name, extra)
+		fmt.Printf("%-10s %-10s %5s %12s %12s %12s %9s\n", "category", "parameter", "N", "mean_dev", "mean_abs", "rmsd", "rel(%)")
+		for _, c := range compareCategories {
+			bypar := make(map[string][]*deviation)
+			for _, d := range devs {
+				if d.category != c {
+					continue
+				}
+				if _, ok := bypar[d.param]; !ok && !containsString(paramorder[c], d.param) {
+					paramorder[c] = append(paramorder[c], d.param)
+				}
+				bypar[d.param] = append(bypar[d.param], d)
+				fout.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%g\t%g\t%g\n", name, c, strings.TrimSpace(BeadsText(minusOne(d.beads))), d.param, d.unit, d.ref, d.test, d.diff()))
+			}
+			for _, p := range paramorder[c] {
+				if len(bypar[p]) == 0 {
+					continue
+				}
+				mean, mad, rms, rel := devStats(bypar[p])
+				fmt.Printf("%-10s %-10s %5d %12.4g %12.4g %12.4g %9.2f\n", c, p, len(bypar[p]), mean, mad, rms, rel)
+				if plotdata[c] == nil {
+					plotdata[c] = make(map[string][][]float64)
+				}
+				if plotdata[c][p] == nil {
+					plotdata[c][p] = make([][]float64, len(names)-1)
+				}
+				for _, d := range bypar[p] {
+					plotdata[c][p][i] = append(plotdata[c][p][i], d.diff())
+				}
+			}
+		}
+	}
+	if *noplot {
+		return
+	}
+	labels := make([]string, len(names))
+	for i, v := range names {
+		labels[i] = filepath.Base(v)
+	}
+	for _, c := range compareCategories {
+		for _, p := range paramorder[c] {
+			if err := BoxPlot(plotdata[c][p], labels[1:], fmt.Sprintf("%s: deviations of %s", c, p), fmt.Sprintf("compare_%s_%s", c, p)); err != nil {
+				LogV(0, "Couldn't produce the plot: ", err.Error())
+			}
+		}
+		rmsds := make([][]float64, len(names))
+		found := false
+		for i, v := range entries {
+			for _, e := range v {
+				if e.category == c && !math.IsNaN(e.rmsd) {
+					rmsds[i] = append(rmsds[i], e.rmsd)
+					found = true
+				}
+			}
+		}
+		if !found {
+			continue
+		}
+		if err := BoxPlot(rmsds, labels, fmt.Sprintf("%s: RMSD of the fits", c), fmt.Sprintf("compare_%s_rmsd", c)); err != nil {
+			LogV(0, "Couldn't produce the plot: ", err.Error())
+		}
+	}
+}
+
+//minusOne returns a copy of the 1-based indexes in a, as 0-based indexes.
+func minusOne(a []int) []int {
+	ret := make([]int, len(a))
+	for i, v := range a {
+		ret[i] = v - 1
+	}
+	return ret
+}
+
+//BoxPlot produces a box plot with one box for each slice in values, labeled with the corresponding element of labels.
+//Empty slices are left out. The plot is saved to a file name.png
+func BoxPlot(values [][]float64, labels []string, title, name string) error {
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+	p.Title.Text = title
+	p.Add(plotter.NewGrid())
+	for i, v := range values {
+		if len(v) == 0 {
+			continue
+		}
+		b, err := plotter.NewBoxPlot(vg.Points(20), float64(i), plotter.Values(v))
+		if err != nil {
+			return err
+		}
+		p.Add(b)
+	}
+	p.NominalX(labels...)
+	p.X.Min, p.X.Max = -0.5, float64(len(values))-0.5
+	return p.Save(6*vg.Inch, 6*vg.Inch, name+".png")
+}
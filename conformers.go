@@ -0,0 +1,247 @@
+/*
+ * conformers.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	chem "github.com/rmera/gochem"
+	"github.com/rmera/gochem/qm"
+	v3 "github.com/rmera/gochem/v3"
+)
+
+//Settings for the conformer search.
+const (
+	mtdTime       = 20   //ps, the length of the metadynamics run
+	mtdCandidates = 20   //the number of frames of the metadynamics that are optimized
+	confWindow    = 25.0 //kJ/mol (about 6 kcal/mol). Conformers with higher energies than this, relative to the lowest one, are discarded
+	confRMSD      = 0.5  //A. Conformers closer than this to another one, with a lower energy, are considered duplicates
+)
+
+//The names of the files with the pre-optimized geometry and the conformers, in the work directory.
+const preoptName = "preopt.xyz"
+const conformersName = "conformers.xyz"
+
+//xtbDefaults fills the settings needed for xtb calculations that are not given in S.
+func xtbDefaults(S *MDSettings) {
+	if S.method == "" {
+		S.method = "gfn0"
+	}
+	if S.temp == 0 {
+		S.temp = 298.0
+	}
+	if S.cpus < 0 {
+		S.cpus = runtime.NumCPU()
+	}
+	S.SetDefaults()
+}
+
+//XTBOptimize optimizes the geometry coord with xtb, with the method and solvent in S, in the directory dir.
+//It returns the optimized geometry and its energy, in kJ/mol.
+func XTBOptimize(coord *v3.Matrix, mol chem.AtomMultiCharger, S *MDSettings, dir string) (*v3.Matrix, float64, error) {
+	xtbDefaults(S)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, 0, err
+	}
+	Q := new(qm.Calc)
+	Q.Method = S.method
+	Q.Dielectric = -1 //the solvent is set in the handle
+	Q.Job = qm.Job{Opti: true}
+	xtb, err := newXTBHandle(dir, "gfnOpt", S)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := xtb.BuildInput(coord, mol, Q); err != nil {
+		return nil, 0, err
+	}
+	optname := filepath.Join(dir, "xtbopt.xyz")
+	os.Remove(optname)
+	if err := xtb.Run(true); err != nil {
+		return nil, 0, err
+	}
+	//xtb writes the optimized geometry with its energy, in the same format as its trajectories.
+	E, err := XYZEnergies(optname)
+	if err != nil {
+		return nil, 0, err
+	}
+	opt, err := chem.XYZFileRead(optname)
+	if err != nil {
+		return nil, 0, err
+	}
+	return opt.Coords[0], E[0], nil
+}
+
+//PreOptimize optimizes the geometry coord with xtb, in the sub-directory "preopt" of S.dir, and writes the optimized geometry to
+//the file preoptName, in S.dir. If reuse is true, and that file exists, the geometry in it is returned, and nothing is run.
+func PreOptimize(coord *v3.Matrix, mol chem.AtomMultiCharger, S *MDSettings, reuse bool) (*v3.Matrix, error) {
+	name := filepath.Join(S.dir, preoptName)
+	if reuse {
+		if prev, err := chem.XYZFileRead(name); err == nil {
+			LogV(1, "Using the pre-optimized geometry in", name)
+			return prev.Coords[0], nil
+		}
+	}
+	opt, E, err := XTBOptimize(coord, mol, S, filepath.Join(S.dir, "preopt"))
+	if err != nil {
+		return nil, err
+	}
+	LogV(1, fmt.Sprintf("Geometry pre-optimized with xtb. Energy: %.3f kJ/mol", E))
+	return opt, chem.XYZFileWrite(name, opt, mol)
+}
+
+//A conformer, with its energy in kJ/mol.
+type conformer struct {
+	coord  *v3.Matrix
+	energy float64
+}
+
+//ConformerSearch explores the conformations of mol, starting from coord, with a metadynamics run with xtb, in the
+//sub-directory "conformers" of S.dir. Some frames of the metadynamics are optimized, and the lowest n unique conformers,
+//within the energy window confWindow, are returned, sorted by increasing energy.
+func ConformerSearch(coord *v3.Matrix, mol chem.AtomMultiCharger, S *MDSettings, n int) ([]*conformer, error) {
+	xtbDefaults(S)
+	dir := filepath.Join(S.dir, "conformers")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	Q := new(qm.Calc)
+	Q.Method = S.method
+	Q.Dielectric = -1
+	Q.Job = qm.Job{MD: true}
+	Q.MDTime = mtdTime
+	Q.MDTemp = S.temp
+	xtb, err := newXTBHandle(dir, "gfnMTD", S)
+	if err != nil {
+		return nil, err
+	}
+	if err := xtb.BuildInput(coord, mol, Q); err != nil {
+		return nil, err
+	}
+	//With a $metadyn block in the input, xtb adds to the MD a bias potential that pushes the
+	//molecule away from the structures already visited (they are compared by their RMSD).
+	metadyn := fmt.Sprintf("$metadyn\n save=100\n kpush=%.4f\n alp=1.3\n$end\n", 0.003*float64(mol.Len()))
+	if err := writeXTBMDInput(filepath.Join(dir, "gfnMTD.inp"), S, mtdTime, metadyn); err != nil {
+		return nil, err
+	}
+	trj := filepath.Join(dir, "xtb.trj")
+	os.Remove(trj)
+	if err := xtb.Run(true); err != nil {
+		return nil, err
+	}
+	frames, err := chem.XYZFileRead(trj)
+	if err != nil {
+		return nil, err
+	}
+	step := len(frames.Coords) / mtdCandidates
+	if step < 1 {
+		step = 1
+	}
+	confs := make([]*conformer, 0, mtdCandidates)
+	for i := step - 1; i < len(frames.Coords); i += step {
+		opt, E, err := XTBOptimize(frames.Coords[i], mol, S, filepath.Join(dir, fmt.Sprintf("opt%02d", len(confs))))
+		if err != nil {
+			LogV(1, "Optimization of a conformer candidate failed:", err.Error())
+			continue
+		}
+		confs = append(confs, &conformer{coord: opt, energy: E})
+	}
+	if len(confs) == 0 {
+		return nil, fmt.Errorf("All the optimizations of conformer candidates failed")
+	}
+	confs = uniqueConformers(confs, n)
+	LogV(1, fmt.Sprintf("Conformer search: %d conformers selected, with relative energies up to %.2f kJ/mol", len(confs), confs[len(confs)-1].energy-confs[0].energy))
+	return confs, nil
+}
+
+//uniqueConformers sorts confs by energy and returns up to n of the lowest ones that are within the energy window
+//and are not duplicates of each other.
+func uniqueConformers(confs []*conformer, n int) []*conformer {
+	sort.Slice(confs, func(i, j int) bool { return confs[i].energy < confs[j].energy })
+	ret := make([]*conformer, 0, n)
+	for _, c := range confs {
+		if len(ret) >= n || c.energy-confs[0].energy > confWindow {
+			break
+		}
+		duplicate := false
+		for _, r := range ret {
+			if conformerRMSD(c.coord, r.coord) < confRMSD {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+//conformerRMSD returns the RMSD between a and b after superimposing them. If they can't be superimposed, it returns 0.
+func conformerRMSD(a, b *v3.Matrix) float64 {
+	test := v3.Zeros(a.NVecs())
+	test.Copy(a)
+	test, err := chem.Super(test, b)
+	if err != nil {
+		return 0
+	}
+	rmsd, err := chem.RMSD(test, b)
+	if err != nil {
+		return 0
+	}
+	return rmsd
+}
+
+//Conformers returns the lowest n conformers of mol found by ConformerSearch, starting from coord, and writes them to the
+//file conformersName in S.dir. If reuse is true, and that file exists, the conformers in it are returned, and nothing is run.
+func Conformers(coord *v3.Matrix, mol chem.AtomMultiCharger, S *MDSettings, n int, reuse bool) ([]*v3.Matrix, error) {
+	confname := filepath.Join(S.dir, conformersName)
+	if prev, err := chem.XYZFileRead(confname); reuse && err == nil {
+		LogV(1, "Using the conformers in", confname)
+		return prev.Coords, nil
+	}
+	found, err := ConformerSearch(coord, mol, S, n)
+	if err != nil {
+		return nil, err
+	}
+	fout, err := os.Create(confname)
+	if err != nil {
+		return nil, err
+	}
+	defer fout.Close()
+	confs := make([]*v3.Matrix, 0, len(found))
+	for _, v := range found {
+		confs = append(confs, v.coord)
+		if err := chem.XYZWrite(fout, v.coord, mol); err != nil {
+			return nil, err
+		}
+	}
+	return confs, nil
+}
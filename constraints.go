@@ -0,0 +1,389 @@
+/*
+ * constraints.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/mat"
+)
+
+//ConstraintPolicy decides which bonds are written as constraints.
+type ConstraintPolicy struct {
+	mode    string  //threshold, none, all or rings
+	k       float64 //bonds with force constants of at least this are constraints (kJ/mol/nm^2)
+	comment float64 //bonds that are not constraints, but have at least this force constant, are also written as commented constraints
+	max     float64 //constraints with at least this force constant are not written as commented bonds
+	ringk   float64 //in the rings mode, ring systems whose bonds all have at least this force constant are made rigid
+	hingek  float64 //force constant for the improper dihedrals that keep the hinges flat (kJ/mol/rad^2)
+}
+
+//DefaultConstraintPolicy returns the policy Bartender has always used: bonds with force constants of at least 25000 kJ/mol/nm^2
+//are constraints.
+func DefaultConstraintPolicy() *ConstraintPolicy {
+	return &ConstraintPolicy{mode: "threshold", k: 25000, comment: 20000, max: 50000, ringk: 5000, hingek: 200}
+}
+
+//Check returns an error if the mode of P is not valid, so it can be reported before the MD, instead of after the fits.
+func (P *ConstraintPolicy) Check() error {
+	switch P.mode {
+	case "threshold", "none", "all", "rings":
+		return nil
+	}
+	return fmt.Errorf("Unknown constraint policy: %s. Valid options are threshold, none, all and rings", P.mode)
+}
+
+//The tolerance, in radians, for a hinge to be considered flat.
+const hingeFlat = 10.0 * chem.Deg2Rad
+
+//ApplyConstraintPolicy marks the bonds in params that are constraints, according to P. In the rings mode, the ring systems
+//(found from the bonds in params) whose bonds are all stiff enough are made rigid, following the Martini 3 practice. Systems of 3 beads
+//get all their bonds as constraints. In larger ones, 4 beads form a constrained "hinge" (two triangles sharing an edge, with an improper
+//dihedral that keeps it as flat as it is in the reference geometry coord, mapped to the beads with beads and weights), and the other beads
+//are virtual sites, built from the hinge beads. The constraints and impropers added are appended to params, and the interactions of
+//the virtual beads are commented out. It returns the virtual sites, which still need to be fitted (see FitVirtualSites).
+func ApplyConstraintPolicy(params map[string][]*bonded, P *ConstraintPolicy, coord *v3.Matrix, mol chem.Atomer, beads [][]int, weights [][]float64) ([]*VirtualSite, error) {
+	if err := P.Check(); err != nil {
+		return nil, err
+	}
+	for _, v := range params["bonds"] {
+		if v.err != nil {
+			continue
+		}
+		switch P.mode {
+		case "threshold", "rings":
+			v.constraint = v.params[1] >= P.k
+		case "none":
+			v.constraint = false
+		case "all":
+			v.constraint = true
+		}
+	}
+	if P.mode != "rings" {
+		return nil, nil
+	}
+	pos := make([]*v3.Matrix, len(beads))
+	for i, v := range beads {
+		pos[i] = WCOM(coord, mol, v, weights[i])
+	}
+	vsites := make([]*VirtualSite, 0)
+	for _, system := range RingSystems(params["bonds"]) {
+		rigid := true
+		for _, b := range system {
+			if b.err != nil || b.params[1] < P.ringk {
+				rigid = false
+			}
+		}
+		if !rigid {
+			LogV(1, fmt.Sprintf("The ring system with the bonds between beads %s is not stiff enough to be made rigid", ringText(system)))
+			continue
+		}
+		added, improper, vs := hingeSetup(system, pos, P.hingek)
+		params["bonds"] = append(params["bonds"], added...)
+		if improper != nil {
+			params["improp"] = append(params["improp"], improper)
+		}
+		for _, v := range vs {
+			commentVirtual(params, v.bead)
+		}
+		vsites = append(vsites, vs...)
+		LogV(1, fmt.Sprintf("The ring system with the bonds between beads %s was made rigid: %d constraints added, and %d virtual sites", ringText(system), len(added), len(vs)))
+	}
+	return vsites, nil
+}
+
+//commentVirtual comments out the interactions in params that involve bead, which has become a virtual site.
+func commentVirtual(params map[string][]*bonded, bead int) {
+	for k, v := range params {
+		for _, b := range v {
+			if b.err != nil || !containsInt(b.beads, bead) {
+				continue
+			}
+			if k == "bonds" {
+				b.constraint = false
+			}
+			b.commented = true
+			note := fmt.Sprintf("bead %d is a virtual site of a rigid ring system", bead+1)
+			if b.note != "" {
+				note += "; " + b.note
+			}
+			b.note = note
+		}
+	}
+}
+
+//ringText returns the beads of each bond in bonds, separated by commas.
+func ringText(bonds []*bonded) string {
+	ret := ""
+	for i, v := range bonds {
+		if i > 0 {
+			ret += ","
+		}
+		ret += BeadsText(v.beads)
+	}
+	return ret
+}
+
+//RingSystems returns the ring systems (sets of fused rings) formed by bonds, each as the list of its bonds.
+//A bond belongs to a ring if its beads remain connected when it is removed.
+func RingSystems(bonds []*bonded) [][]*bonded {
+	connected := func(a, b int, skip *bonded) bool {
+		seen := map[int]bool{a: true}
+		queue := []int{a}
+		for len(queue) > 0 {
+			c := queue[0]
+			queue = queue[1:]
+			if c == b {
+				return true
+			}
+			for _, v := range bonds {
+				if v == skip {
+					continue
+				}
+				for i, w := range v.beads {
+					other := v.beads[1-i]
+					if w == c && !seen[other] {
+						seen[other] = true
+						queue = append(queue, other)
+					}
+				}
+			}
+		}
+		return false
+	}
+	inring := make([]*bonded, 0, len(bonds))
+	for _, v := range bonds {
+		if connected(v.beads[0], v.beads[1], v) {
+			inring = append(inring, v)
+		}
+	}
+	//Ring bonds sharing a bead belong to the same system.
+	ret := make([][]*bonded, 0, 2)
+	used := make(map[*bonded]bool)
+	for _, v := range inring {
+		if used[v] {
+			continue
+		}
+		used[v] = true
+		system := []*bonded{v}
+		for i := 0; i < len(system); i++ {
+			for _, w := range inring {
+				if !used[w] && sharesBead(system[i], w) {
+					used[w] = true
+					system = append(system, w)
+				}
+			}
+		}
+		ret = append(ret, system)
+	}
+	return ret
+}
+
+func sharesBead(a, b *bonded) bool {
+	for _, v := range a.beads {
+		for _, w := range b.beads {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//hingeSetup makes rigid the ring system formed by the bonds in system, with the bead positions pos. The 4 beads that span the
+//largest area, projected on the plane of the system, form the hinge: their bonds are constraints, and constraints, with the lengths in pos,
+//are added for the sides of the quadrilateral they form that are not bonds, and for its shortest diagonal. It returns the constraints added,
+//the improper dihedral, with the force constant k, for the hinge, and the virtual sites for the other beads, each built from the 3 hinge
+//beads closest to it. A system of 3 beads only gets its bonds as constraints.
+func hingeSetup(system []*bonded, pos []*v3.Matrix, k float64) ([]*bonded, *bonded, []*VirtualSite) {
+	members := make([]int, 0, len(system))
+	edges := make(map[[2]int]*bonded)
+	for _, b := range system {
+		for _, v := range b.beads {
+			if !containsInt(members, v) {
+				members = append(members, v)
+			}
+		}
+		edges[pairKey(b.beads[0], b.beads[1])] = b
+	}
+	sort.Ints(members)
+	if len(members) <= 3 {
+		for _, b := range system {
+			b.constraint = true
+		}
+		return nil, nil, nil
+	}
+	plane := planeCoords(members, pos)
+	//For each set of 4 beads, the pairing of the beads whose segments cross are the diagonals of a convex quadrilateral.
+	var hinge [2][2]int //the two diagonals
+	best := 0.0
+	for a := 0; a < len(members); a++ {
+		for b := a + 1; b < len(members); b++ {
+			for c := b + 1; c < len(members); c++ {
+				for d := c + 1; d < len(members); d++ {
+					q := [4]int{members[a], members[b], members[c], members[d]}
+					for _, diag := range [][2][2]int{{{q[0], q[2]}, {q[1], q[3]}}, {{q[0], q[1]}, {q[2], q[3]}}, {{q[0], q[3]}, {q[1], q[2]}}} {
+						p1, p2, p3, p4 := plane[diag[0][0]], plane[diag[0][1]], plane[diag[1][0]], plane[diag[1][1]]
+						if !segmentsCross(p1, p2, p3, p4) {
+							continue
+						}
+						area := 0.5 * math.Abs((p2[0]-p1[0])*(p4[1]-p3[1])-(p2[1]-p1[1])*(p4[0]-p3[0]))
+						if area > best {
+							best, hinge = area, diag
+						}
+					}
+				}
+			}
+		}
+	}
+	if best == 0 {
+		LogV(0, fmt.Sprintf("No 4 beads of the ring system with the bonds between beads %s form a quadrilateral, so only its bonds are constraints", ringText(system)))
+		for _, b := range system {
+			b.constraint = true
+		}
+		return nil, nil, nil
+	}
+	//The shortest diagonal is constrained, and is the edge of the hinge.
+	if beadDist(pos, hinge[1][0], hinge[1][1]) < beadDist(pos, hinge[0][0], hinge[0][1]) {
+		hinge[0], hinge[1] = hinge[1], hinge[0]
+	}
+	e0, e1 := hinge[0][0], hinge[0][1]
+	o0, o1 := hinge[1][0], hinge[1][1]
+	hingebeads := []int{e0, e1, o0, o1}
+	bondpot := PotentialFor("bonds", 1)
+	added := make([]*bonded, 0, 5)
+	for _, pair := range [][2]int{{e0, e1}, {o0, e0}, {o0, e1}, {o1, e0}, {o1, e1}} {
+		if b, ok := edges[pairKey(pair[0], pair[1])]; ok {
+			b.constraint = true
+			continue
+		}
+		b := NewBonded(-1, []int{pair[0], pair[1]}, []float64{beadDist(pos, pair[0], pair[1]) / 10, 0}, math.NaN(), bondpot, false)
+		b.constraint, b.built = true, true
+		b.note = "hinge constraint, from the reference geometry"
+		added = append(added, b)
+	}
+	//A bond across the other diagonal would overdetermine the hinge.
+	if b, ok := edges[pairKey(o0, o1)]; ok {
+		b.constraint, b.commented = false, true
+		b.note = "the hinge of the rigid ring system is already rigid"
+	}
+	//The first ordering of the beads with the first one before the second, so the improper can also be written for OpenMM (see openmmImproper).
+	ib := []int{o0, e0, e1, o1}
+	for _, v := range [][]int{{o1, e0, e1, o0}, {o0, e1, e0, o1}, {o1, e1, e0, o0}} {
+		if ib[0] < ib[1] {
+			break
+		}
+		ib = v
+	}
+	eq := chem.Improper(pos[ib[0]], pos[ib[1]], pos[ib[2]], pos[ib[3]])
+	if math.Abs(eq) < hingeFlat {
+		eq = 0
+	} else if math.Abs(eq-math.Pi) < hingeFlat {
+		eq = math.Pi
+	}
+	improper := NewBonded(-1, ib, []float64{eq * chem.Rad2Deg, k}, math.NaN(), PotentialFor("improp", 2), false)
+	improper.built = true
+	improper.note = "hinge improper, from the reference geometry"
+	vsites := make([]*VirtualSite, 0, len(members)-4)
+	for _, m := range members {
+		if containsInt(hingebeads, m) {
+			continue
+		}
+		from := append([]int{}, hingebeads...)
+		sort.Slice(from, func(i, j int) bool { return beadDist(pos, m, from[i]) < beadDist(pos, m, from[j]) })
+		vsites = append(vsites, &VirtualSite{bead: m, from: from[:3], funct: 1})
+	}
+	return added, improper, vsites
+}
+
+//planeCoords returns the coordinates of the beads in members, projected on the plane that best fits them.
+func planeCoords(members []int, pos []*v3.Matrix) map[int][2]float64 {
+	center := make([]float64, 3)
+	for _, m := range members {
+		for j := range center {
+			center[j] += pos[m].At(0, j) / float64(len(members))
+		}
+	}
+	cov := mat.NewSymDense(3, nil)
+	for _, m := range members {
+		for i := 0; i < 3; i++ {
+			for j := i; j < 3; j++ {
+				cov.SetSym(i, j, cov.At(i, j)+(pos[m].At(0, i)-center[i])*(pos[m].At(0, j)-center[j]))
+			}
+		}
+	}
+	var eig mat.EigenSym
+	var vecs mat.Dense
+	eig.Factorize(cov, true)
+	eig.VectorsTo(&vecs)
+	//The eigenvalues are in ascending order, so the last two vectors span the plane.
+	ret := make(map[int][2]float64)
+	for _, m := range members {
+		var p [2]float64
+		for k := 0; k < 2; k++ {
+			for j := 0; j < 3; j++ {
+				p[k] += (pos[m].At(0, j) - center[j]) * vecs.At(j, k+1)
+			}
+		}
+		ret[m] = p
+	}
+	return ret
+}
+
+//segmentsCross returns true if the segments ab and cd cross each other.
+func segmentsCross(a, b, c, d [2]float64) bool {
+	orient := func(p, q, r [2]float64) float64 {
+		return (q[0]-p[0])*(r[1]-p[1]) - (q[1]-p[1])*(r[0]-p[0])
+	}
+	return orient(a, b, c)*orient(a, b, d) < 0 && orient(c, d, a)*orient(c, d, b) < 0
+}
+
+func beadDist(pos []*v3.Matrix, a, b int) float64 {
+	d := v3.Zeros(1)
+	d.Sub(pos[a], pos[b])
+	return d.Norm(2)
+}
+
+func pairKey(a, b int) [2]int {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]int{a, b}
+}
+
+func containsInt(s []int, test int) bool {
+	for _, v := range s {
+		if v == test {
+			return true
+		}
+	}
+	return false
+}
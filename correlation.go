@@ -0,0 +1,247 @@
+/*
+ * correlation.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	chem "github.com/rmera/gochem"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/stat"
+)
+
+//The number of bins per dimension used to estimate the mutual information and
+//to build the free energy surfaces. Fixed, so the estimates for different pairs are comparable.
+const corrBins int = 20
+
+//A time series for one bonded degree of freedom.
+type dofSeries struct {
+	kind  string
+	beads []int
+	data  []float64
+}
+
+//Name returns the kind of degree of freedom and the beads involved, without spaces.
+func (d *dofSeries) Name() string {
+	return strings.ReplaceAll(CategoryName(d.kind), " ", "_") + strings.TrimSpace(BeadsText(d.beads))
+}
+
+//Dihedrals and impropers are periodic. Bending angles are defined between 0 and 180 degrees, so they are not.
+func (d *dofSeries) circular() bool {
+	return d.kind == "dihe" || d.kind == "improp"
+}
+
+//coupling contains the measures of the statistical dependence between two degrees of freedom.
+type coupling struct {
+	a, b     *dofSeries
+	linear   float64 //Pearson correlation coefficient
+	circular float64 //circular-circular or linear-circular correlation, NaN if neither is circular.
+	mi       float64 //mutual information, in nats
+	nmi      float64 //mutual information normalized by the smallest of the two entropies, between 0 and 1.
+}
+
+//Strong returns true if any of the correlations, or the normalized mutual information,
+//has an absolute value equal or larger than threshold. The linear correlation is not used if
+//either degree of freedom is circular, as the jump at +/-180 degrees makes it meaningless.
+func (c *coupling) Strong(threshold float64) bool {
+	measures := []float64{c.linear, c.circular, c.nmi}
+	if c.a.circular() || c.b.circular() {
+		measures = measures[1:]
+	}
+	for _, v := range measures {
+		if !math.IsNaN(v) && math.Abs(v) >= threshold {
+			return true
+		}
+	}
+	return false
+}
+
+//dofList returns all the time series in datamap, labeled with the beads in wanted.
+func dofList(datamap map[string][][]float64, wanted map[string][][]int) []*dofSeries {
+	ret := make([]*dofSeries, 0, 10)
+	for _, k := range []string{"bonds", "angles", "reb", "dihe", "improp"} {
+		for i, v := range datamap[k] {
+			ret = append(ret, &dofSeries{kind: k, beads: wanted[k][i], data: v})
+		}
+	}
+	return ret
+}
+
+//Couplings obtains the linear and circular correlations, and the mutual information
+//between every pair of degrees of freedom in datamap. If weights is not nil, each frame
+//is counted with its weight (for instance, from the reweighting of a REMD).
+func Couplings(datamap map[string][][]float64, wanted map[string][][]int, weights []float64) []*coupling {
+	dofs := dofList(datamap, wanted)
+	entropies := make([]float64, len(dofs))
+	for i, v := range dofs {
+		entropies[i] = NewJointHistogram([][]float64{v.data}, []float64{corrWidth(v.data)}, weights).Entropy()
+	}
+	ret := make([]*coupling, 0, len(dofs)*(len(dofs)-1)/2)
+	for i, a := range dofs {
+		for j := i + 1; j < len(dofs); j++ {
+			b := dofs[j]
+			c := &coupling{a: a, b: b, circular: math.NaN()}
+			c.linear = stat.Correlation(a.data, b.data, weights)
+			switch {
+			case a.circular() && b.circular():
+				c.circular = circCircCorrelation(a.data, b.data, weights)
+			case a.circular():
+				c.circular = linCircCorrelation(b.data, a.data, weights)
+			case b.circular():
+				c.circular = linCircCorrelation(a.data, b.data, weights)
+			}
+			joint := NewJointHistogram([][]float64{a.data, b.data}, []float64{corrWidth(a.data), corrWidth(b.data)}, weights)
+			c.mi = math.Max(entropies[i]+entropies[j]-joint.Entropy(), 0)
+			if minH := math.Min(entropies[i], entropies[j]); minH > 0 {
+				c.nmi = c.mi / minH
+			}
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+//corrWidth returns the bin width that divides the range of data in corrBins bins.
+func corrWidth(data []float64) float64 {
+	r := floats.Max(data) - floats.Min(data)
+	if r == 0 {
+		return 1 //all the samples go to the same bin anyway.
+	}
+	return r / float64(corrBins-1) //so the largest value doesn't get a bin for itself.
+}
+
+//the circular mean of the angles in data, with the given weights (or all 1, if weights is nil).
+func circMean(data, weights []float64) float64 {
+	var s, c float64
+	for i, v := range data {
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		s += w * math.Sin(v)
+		c += w * math.Cos(v)
+	}
+	return math.Atan2(s, c)
+}
+
+//circCircCorrelation returns the circular correlation coefficient between the angles a and b,
+//as defined by Jammalamadaka and SenGupta, with the given weights for the samples (all 1, if weights is nil).
+//It is between -1 and 1.
+func circCircCorrelation(a, b, weights []float64) float64 {
+	ma := circMean(a, weights)
+	mb := circMean(b, weights)
+	var num, da, db float64
+	for i, v := range a {
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		sa := math.Sin(v - ma)
+		sb := math.Sin(b[i] - mb)
+		num += w * sa * sb
+		da += w * sa * sa
+		db += w * sb * sb
+	}
+	return num / math.Sqrt(da*db)
+}
+
+//linCircCorrelation returns Mardia's correlation coefficient between the linear variable x and the angle theta.
+//The samples have the given weights (all 1, if weights is nil). It is between 0 and 1.
+func linCircCorrelation(x, theta, weights []float64) float64 {
+	s := make([]float64, len(theta))
+	c := make([]float64, len(theta))
+	for i, v := range theta {
+		s[i] = math.Sin(v)
+		c[i] = math.Cos(v)
+	}
+	rxc := stat.Correlation(x, c, weights)
+	rxs := stat.Correlation(x, s, weights)
+	rcs := stat.Correlation(c, s, weights)
+	r2 := (rxc*rxc + rxs*rxs - 2*rxc*rxs*rcs) / (1 - rcs*rcs)
+	return math.Sqrt(math.Max(r2, 0))
+}
+
+//CouplingAnalysis obtains the couplings between all the degrees of freedom in datamap, writes them to the file outname
+//and reports the pairs that are strongly coupled, according to threshold, which should be treated with care, as the
+//fitted potentials assume independent degrees of freedom. If fes is true, the free energy surfaces for those pairs
+//are written, at the given temperature. If weights is not nil, each frame is counted with its weight.
+func CouplingAnalysis(datamap map[string][][]float64, wanted map[string][][]int, weights []float64, threshold float64, fes bool, temperature float64, outname string) {
+	cs := Couplings(datamap, wanted, weights)
+	fout, err := os.Create(outname)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer fout.Close()
+	fout.WriteString("# Couplings between bonded degrees of freedom by Bartender - www.github.com/rmera/bartender\n")
+	fout.WriteString("# dof1\tdof2\tlinear\tcircular\tMI(nats)\tnormalized_MI\tstrong\n")
+	for _, c := range cs {
+		strong := c.Strong(threshold)
+		fout.WriteString(fmt.Sprintf("%s\t%s\t%.4f\t%.4f\t%.4f\t%.4f\t%t\n", c.a.Name(), c.b.Name(), c.linear, c.circular, c.mi, c.nmi, strong))
+		if !strong {
+			continue
+		}
+		LogV(1, fmt.Sprintf("The %s between beads %s and the %s between beads %s are strongly coupled (linear correlation: %5.2f, circular correlation: %5.2f, normalized mutual information: %5.2f). Their potentials, fitted independently, may not reproduce their joint distribution", CategoryName(c.a.kind), BeadsText(c.a.beads), CategoryName(c.b.kind), BeadsText(c.b.beads), c.linear, c.circular, c.nmi))
+		if fes {
+			if err := WriteFES(c, weights, temperature); err != nil {
+				LogV(0, "Couldn't write free energy surface:", err.Error())
+			}
+		}
+	}
+}
+
+//WriteFES writes the 2D free energy surface, from the joint distribution of the two degrees of freedom of c, to
+//a file FES_dof1_dof2.dat, with the values of each degree of freedom (nm or degrees) and the free energy (kJ/mol)
+//in columns, in a format that gnuplot can use directly. Empty bins are not written. If weights is not nil, each frame
+//is counted with its weight.
+func WriteFES(c *coupling, weights []float64, temperature float64) error {
+	H := NewJointHistogram([][]float64{c.a.data, c.b.data}, []float64{corrWidth(c.a.data), corrWidth(c.b.data)}, weights)
+	x, G := H.IBoltzmann(temperature)
+	fout, err := os.Create(fmt.Sprintf("FES_%s_%s.dat", c.a.Name(), c.b.Name()))
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	conv := []float64{1, 1}
+	for i, v := range []*dofSeries{c.a, c.b} {
+		if v.kind != "bonds" {
+			conv[i] = chem.Rad2Deg
+		}
+	}
+	fout.WriteString(fmt.Sprintf("# %s\t%s\tG(kJ/mol)\n", c.a.Name(), c.b.Name()))
+	prev := math.NaN()
+	for i, v := range G {
+		if x[0][i] != prev && !math.IsNaN(prev) {
+			fout.WriteString("\n") //blank lines between rows of the grid, as gnuplot expects.
+		}
+		prev = x[0][i]
+		fout.WriteString(fmt.Sprintf("%.4f\t%.4f\t%.4f\n", x[0][i]*conv[0], x[1][i]*conv[1], v))
+	}
+	return nil
+}
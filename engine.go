@@ -0,0 +1,94 @@
+/*
+ * engine.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+)
+
+//MDEngine is a program, or method, that can run an MD simulation for a molecule.
+type MDEngine interface {
+	//Name returns the name of the engine
+	Name() string
+
+	//TrajName returns the name of the trajectory the engine writes with the settings S, also while the MD is running.
+	//For replica-exchange engines, it is the name of the replica list.
+	TrajName(S *MDSettings) string
+
+	//Run performs the MD for the molecule mol, starting from the coordinates coord, with the settings S.
+	//Settings not given (i.e. with the zero value) are filled with the defaults of the engine.
+	Run(coord *v3.Matrix, mol chem.AtomMultiCharger, S *MDSettings) (*MDOutput, error)
+}
+
+//MDOutput contains the results of an MD run.
+type MDOutput struct {
+	engine   string
+	trajname string   //multi-XYZ trajectory, with the energy of each frame (Hartree) in its comment line, as xtb writes it.
+	replicas string   //for replica-exchange simulations, the list of replicas (see ReadReplicaList). Empty otherwise.
+	parts    []string //for several independent runs merged in trajname, their trajectories, in order. Nil otherwise.
+	temp     float64  //K
+	time     int      //ps
+}
+
+//Traj opens the trajectory produced by the run.
+func (o *MDOutput) Traj() (chem.Traj, error) {
+	if !strings.HasSuffix(o.trajname, ".trj") {
+		return OpenTraj(o.trajname) //a trajectory given by the user, in any of the formats supported.
+	}
+	_, traj, err := chem.XYZFileAsTraj(o.trajname)
+	return traj, err
+}
+
+func (o *MDOutput) String() string {
+	ret := fmt.Sprintf("MD with %s: %d ps at %5.1f K, trajectory: %s", o.engine, o.time, o.temp, o.trajname)
+	if o.replicas != "" {
+		ret += ", replica list: " + o.replicas
+	}
+	return ret
+}
+
+//NewMDEngine returns the engine with the given name. If remd is true, the engine will run a replica-exchange
+//simulation, using the named engine for each replica.
+func NewMDEngine(name string, remd bool) (MDEngine, error) {
+	var ret MDEngine
+	switch name {
+	case "xtb", "":
+		ret = xtbEngine{}
+	case "mock":
+		ret = mockEngine{}
+	default:
+		return nil, fmt.Errorf("Unknown MD engine: %s", name)
+	}
+	if remd {
+		ret = &remdEngine{inner: ret}
+	}
+	return ret, nil
+}
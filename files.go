@@ -30,10 +30,24 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+
+	chem "github.com/rmera/gochem"
 )
 
+//ReadGeometry reads the molecule in the file geoname, in PDB, GRO or XYZ format, according to its extension.
+func ReadGeometry(geoname string) (*chem.Molecule, error) {
+	switch strings.ToLower(filepath.Ext(geoname)) {
+	case ".gro":
+		return chem.GroFileRead(geoname)
+	case ".pdb":
+		return chem.PDBFileRead(geoname, false)
+	}
+	return chem.XYZFileRead(geoname)
+}
+
 //parses the input file, returns an slice of slices of ints,
 //where the nth slice contains the atoms in the nth Martini bead
 //and aslice of slices of float64, where the nth slice contains, for each atom, the fraction of the
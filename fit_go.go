@@ -27,42 +27,62 @@
 package main
 
 import (
+	"fmt"
 	"math"
-	"math/rand"
 	"sort"
 
 	"gonum.org/v1/gonum/diff/fd"
+	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
-	"gonum.org/v1/gonum/optimize"
 )
 
-//The cosine-based function for angles
-func GoCosAngleFit(x, y []float64) ([]float64, float64) {
-	score := func(par []float64) float64 {
-		eq := par[0]
-		k := par[1]
-		//		b := par[2]
-		//		c := par[3]
+//FitPotential fits the potential p to the energies y at the points x, with the minimization settings O.
+//It returns the parameters, in internal units, and the RMSD of the fit, or an error if the fit failed.
+func FitPotential(p Potential, x, y []float64, O *OptSettings) ([]float64, float64, error) {
+	if f, ok := p.(Fitter); ok {
+		return f.Fit(x, y, O)
+	}
+	return genericFit(p, x, y, O)
+}
+
+//genericFit fits p by minimizing the sum of the squared residues, within the bounds for its parameters.
+func genericFit(p Potential, x, y []float64, O *OptSettings) ([]float64, float64, error) {
+	if len(y) < len(p.ParNames()) {
+		return nil, math.NaN(), fmt.Errorf("only %d points to fit %d parameters", len(y), len(p.ParNames()))
+	}
+	score := potentialScore(p, y, x)
+	guess := p.Guess(x, y)
+	ret, res, err := Fit(score, guess, Bounds(p), O)
+	return ret, math.Sqrt(res * 2), err
+}
+
+//potentialScore returns a function that gives the sum of the squared residues between y and the energy of p,
+//for a set of parameters, divided by twice the number of points.
+//x contains one slice per degree of freedom of the potential, each with one element per point.
+func potentialScore(p Potential, y []float64, x ...[]float64) func([]float64) float64 {
+	return func(par []float64) float64 {
+		E := p.Energy(par)
+		pt := make([]float64, len(x))
 		var r2 float64 = 0.0
 		for i, v := range y {
-			p := 0.5 * k * math.Pow((math.Cos(x[i])-math.Cos(eq)), 2.0)
-			r2 += math.Pow((v - p), 2.0)
+			for j, w := range x {
+				pt[j] = w[i]
+			}
+			r2 += math.Pow(v-E(pt...), 2.0)
 		}
-		return r2 / (2 * float64(len(x)))
+		return r2 / (2 * float64(len(y)))
 	}
+}
+
+//numerical gradient and Hessian for a score function
+func numDerivs(score func([]float64) float64) (func([]float64, []float64), func(*mat.SymDense, []float64)) {
 	ngrad := func(g, par []float64) {
 		g = fd.Gradient(g, score, par, &fd.Settings{Formula: fd.Central})
 	}
 	nhess := func(hess *mat.SymDense, par []float64) {
 		fd.Hessian(hess, score, par, nil) //&fd.Settings{Formula: fd.Central2nd})
-
 	}
-	//I'll just be using the ReB guess for this one.
-	guess := cosangleGuess(x, y)
-	iterations := -1 //tells Fit to use its default
-	ret, res := Fit(score, ngrad, nhess, guess, iterations)
-	return ret, math.Sqrt(res * 2)
-
+	return ngrad, nhess
 }
 
 func cosangleGuess(x, y []float64) []*float64 {
@@ -74,55 +94,6 @@ func cosangleGuess(x, y []float64) []*float64 {
 
 }
 
-//The Harmonic function for bonds and angles
-func GoHookeFit(x, y []float64) ([]float64, float64) {
-	//produces a function that will return the sum of the squared residues for a y = 1/2*k*(x-eq)^2
-	score := func(par []float64) float64 {
-		eq := par[0]
-		k := par[1]
-		//		b := par[2]
-		//		c := par[3]
-		var r2 float64 = 0.0
-		for i, v := range y {
-			p := 0.5 * k * math.Pow((x[i]-eq), 2.0)
-			r2 += math.Pow((v - p), 2.0)
-		}
-		return r2 / (2 * float64(len(x)))
-	}
-	ngrad := func(g, par []float64) {
-		g = fd.Gradient(g, score, par, &fd.Settings{Formula: fd.Central})
-	}
-	nhess := func(hess *mat.SymDense, par []float64) {
-		fd.Hessian(hess, score, par, nil) //&fd.Settings{Formula: fd.Central2nd})
-
-	}
-	//analytic gradient, but I am  likely to have made a mistake or 2.
-	agrad := func(g, par []float64) {
-		eq := par[0]
-		k := par[1]
-		var geq, gk float64
-		for i, v := range y {
-			p := 0.5 * k * math.Pow((x[i]-eq), 2.0)
-			ppeq := 0.5 * k * 2 * (x[i] - eq) * x[i]
-			ppk := 0.5 * math.Pow((x[i]-eq), 2.0)
-			geq += 2 * (v - p) * v * ppeq
-			gk += 2 * (v - p) * v * ppk
-
-		}
-		g[0] = geq / 2 * float64(len(x))
-		g[1] = gk / 2 * float64(len(x))
-
-	}
-	_ = agrad ////////one can choose
-
-	//	g3:=1
-	//	g4 := 0.0
-	guess := hookeGuess(x, y)
-	iterations := -1 //tells fit to use its default
-	ret, res := Fit(score, ngrad, nhess, guess, iterations)
-	return ret, math.Sqrt(res * 2)
-}
-
 func hookeGuess(x, y []float64) []*float64 {
 	ret := make([]*float64, 2)
 	geq := 1.0
@@ -168,14 +139,17 @@ func angleSearch(angle []int, set [][]int) int {
 	return -1
 }
 
-func ManageBendingTorsion(datamap map[string][][]float64, wanted map[string][][]int, dihekey int, temperature float64, increments []float64) ([]float64, float64) {
+//ManageBendingTorsion fits the combined bending-torsion potential for the dihedral dihekey, if the two
+//bending angles that form it are also in wanted. It returns the fitted interaction, commented, or an error
+//if the fit failed. If the angles are not available, both the interaction and the error are nil.
+func ManageBendingTorsion(datamap map[string][][]float64, wanted map[string][][]int, dihekey int, S *FitSettings) (*bonded, error) {
 	dbeads := wanted["dihe"][dihekey]
 	angle1 := []int{dbeads[0], dbeads[1], dbeads[2]}
 	angle2 := []int{dbeads[1], dbeads[2], dbeads[3]}
 	akey1 := angleSearch(angle1, wanted["angles"])
 	akey2 := angleSearch(angle2, wanted["angles"])
 	if akey1 == -1 || akey2 == -1 {
-		return nil, -100 //we'll use this negative value to signal issues in this function. In this case, you need to put the corresponding bending angles
+		return nil, nil //In this case, you need to put the corresponding bending angles
 		//if you want a torsion to be given a combined BT potential, if not, it will simply not be calculated, and it will not be considered
 		//an error.
 	}
@@ -183,75 +157,34 @@ func ManageBendingTorsion(datamap map[string][][]float64, wanted map[string][][]
 	tor = datamap["dihe"][dihekey]
 	b1 = datamap["angles"][akey1]
 	b2 = datamap["angles"][akey2]
-	x1, x2, x3, y := IBoltzmannBT(tor, b1, b2, increments, temperature)
+	ia := S.increments["angles"]
+	x1, x2, x3, y := IBoltzmannBT(tor, b1, b2, []float64{S.increments["dihe"], ia, ia}, S.temp, S.weights)
 	//	fmt.Println(len(x1), len(x2), len(x3), len(y)) /////////////////
 	//	for i, v := range y {                          ///////////
 	//		fmt.Println(x1[i], x2[i], x3[i], v) ////////////
 	//	} ////////////////////////////////////////////////////////////////////
-	sin := math.Sin
-	cos := math.Cos
-	pow := math.Pow
-	score := func(par []float64) float64 {
-		k := par[0]
-		//		b := par[2]
-		//		c := par[3]
-		var r2 float64 = 0.0
-		for i, v := range y {
-			acc := 0.0
-			for j := 0; j <= 4; j++ {
-				acc += par[j+1] * pow(cos(x1[i]), float64(j))
-			}
-			p := k * pow(sin(x2[i]), 3) * pow(sin(x3[i]), 3) * acc
-			r2 = r2 + math.Pow((v-p), 2.0)
+	bt := PotentialFor("dihe", 11)
+	score := potentialScore(bt, y, x1, x2, x3)
+	//The energy is linear in the parameters, so a linear fit gives the minimum directly.
+	//Only if that fails, we go for the usual minimization.
+	ret, err := linearFit(bt, y, x1, x2, x3)
+	if err != nil {
+		LogV(2, "Linear fit for the bending-torsion potential failed, will minimize:", err.Error())
+		ret, _, err = Fit(score, bt.Guess(x1, y), Bounds(bt), S.opt)
+		if err != nil {
+			return nil, err
 		}
-		return r2 / (2 * float64(len(x1)))
 	}
-	ngrad := func(g, par []float64) {
-		g = fd.Gradient(g, score, par, &fd.Settings{Formula: fd.Central})
-	}
-	nhess := func(hess *mat.SymDense, par []float64) {
-		fd.Hessian(hess, score, par, nil)
-	}
-	var p1, p2, p3, p4, p5, p6 float64 = 1, 1, 1, 1, 1, 1 //yeah, not getting cute here.
-	guess := []*float64{&p1, &p2, &p3, &p4, &p5, &p6}
-	iterations := -1 //Fit will use its default
-	ret, res := Fit(score, ngrad, nhess, guess, iterations)
-	return ret, math.Sqrt(res * 2)
+	res := score(ret)
+	LogV(3, PlotProjection(bt, ret, [][]float64{x1, x2, x3}, y, BeadsText(dbeads), S.noplot))
+	b := NewBonded(dihekey, dbeads, GromacsPar(bt, ret), math.Sqrt(res*2), bt, true)
+	b.npoints = len(y)
+	b.samples = len(tor)
+	b.SetUncertainties(score, ret, Bounds(bt))
+	return b, nil
 
 }
 
-// The fit for the Restricted Bending potential (ReB).
-// See: https://pubs.acs.org/doi/abs/10.1021/ct400219n
-func GoReBFit(x, y []float64) ([]float64, float64) {
-	//produces a function that will return the sum of the squared residues for a y = 1/2*k*(x-eq)^2
-	score := func(par []float64) float64 {
-		eq := par[0]
-		k := par[1]
-		//		b := par[2]
-		//		c := par[3]
-		var r2 float64 = 0.0
-		for i, v := range y {
-			//In the original file, in the next line we had " math.Pow((math.Cos(x[i])-eq), 2.0)"
-			//I changed it, because I think that was a bug. From what I have seen, nowhere else was the angle transformed to cosine before.
-			p := 0.5 * k * math.Pow((math.Cos(x[i])-math.Cos(eq)), 2.0) * (1 / math.Pow(math.Sin(x[i]), 2)) //I think "eq" should be "cos(eq)" !!!
-			r2 += math.Pow((v - p), 2.0)
-		}
-		return r2 / (2 * float64(len(x)))
-	}
-	ngrad := func(g, par []float64) {
-		g = fd.Gradient(g, score, par, &fd.Settings{Formula: fd.Central})
-	}
-	nhess := func(hess *mat.SymDense, par []float64) {
-		fd.Hessian(hess, score, par, nil) //&fd.Settings{Formula: fd.Central2nd})
-
-	}
-
-	guess := reBGuess(x, y)
-	iterations := -1 //tells Fit to use its default
-	ret, res := Fit(score, ngrad, nhess, guess, iterations)
-	return ret, math.Sqrt(res * 2)
-}
-
 func reBGuess(x, y []float64) []*float64 {
 	cos := math.Cos
 	ret := make([]*float64, 2)
@@ -282,54 +215,8 @@ func reBGuess(x, y []float64) []*float64 {
 
 }
 
-///The fit for the simple  function, such as the one used for dihedrals U = k(1+cos(nphi - phi_eq))
+///The guess for the simple  function, such as the one used for dihedrals U = k(1+cos(nphi - phi_eq))
 //where phi is the angle,  and phi_eq is the equilibrium angle, both in radians.
-
-func GoSimplePeriodicFit(x, y []float64) ([]float64, float64) {
-	//produces a function that will return the sum of the squared residues for a y = 1/2*k*(x-eq)^2
-	score := func(par []float64) float64 {
-		eq := par[0]
-		k := par[1]
-		n := par[2]
-		//		b := par[2]
-		//		c := par[3]
-		var r2 float64 = 0.0
-		for i, v := range y {
-			p := k * (1 + math.Cos(n*x[i]-eq))
-			r2 = r2 + math.Pow((v-p), 2.0)
-		}
-		return r2 / (2 * float64(len(x)))
-	}
-	ngrad := func(g, par []float64) {
-		g = fd.Gradient(g, score, par, &fd.Settings{Formula: fd.Central})
-	}
-	nhess := func(hess *mat.SymDense, par []float64) {
-		fd.Hessian(hess, score, par, nil)
-	}
-	guess := simplePeriodicGuess(x, y)
-	iterations := 10000 //this is 3 orders of magnitude less than the default
-	ret, res := Fit(score, ngrad, nhess, guess, iterations)
-	//We try to forbid periodicity one by discarding the value, if we get it, incrementing the guess by a random number, and fitting again.
-	macroiters := 30
-	cont := 0
-	for (ret[2] == 0 || ret[2] > 3) && cont < macroiters {
-		LogV(2, "Failed fit for simple periodic! will try increasing the n guess")
-		if *guess[2] < 1.0 {
-			*guess[2] = 1.0
-		} else {
-			*guess[2] += rand.Float64() //
-		}
-		ret, res = Fit(score, ngrad, nhess, guess, iterations)
-		cont++
-	}
-	if cont >= macroiters {
-		LogV(1, "Simple periodic fit failed")
-		ret = make([]float64, 3) //empty
-		res = 225.0              //so, 15^2 Just a random large number to make it clear that things went wrong.
-	}
-	return ret, math.Sqrt(2 * res)
-}
-
 func simplePeriodicGuess(x, y []float64) []*float64 {
 	ret := make([]*float64, 3)
 	geq := 1.0
@@ -375,33 +262,56 @@ func simplePeriodicGuess(x, y []float64) []*float64 {
 	return ret
 }
 
-func GoRyckBelleFit(x, y []float64) ([]float64, float64) {
-	//produces a function that will return the sum of the squared residues for a y = 1/2*k*(x-eq)^2
-	score := func(p []float64) float64 {
-		//		b := par[2]
-		//		c := par[3]
-
-		var r2 float64 = 0.0
-		cos := math.Cos
-		pow := math.Pow
-		for i, v := range y {
-			psi := x[i] - math.Pi
-			test := p[0] + p[1]*cos(psi) + p[2]*pow(cos(psi), 2) + p[3]*pow(cos(psi), 3) + p[4]*pow(cos(psi), 4) + p[5]*pow(cos(psi), 5)
-			r2 = r2 + math.Pow((v-test), 2.0)
+//linearFit fits the potential p, whose energy must be linear in its parameters (so the derivatives given
+//by p.Deriv don't depend on them) by linear least squares. No minimization is needed, so this is fast even for many
+//points. As the terms are often nearly linearly dependent (for instance, the powers of the cosine of a torsion that
+//samples a narrow range) the minimum-norm solution, obtained by SVD, is returned.
+//x contains one slice per degree of freedom of the potential, each with one element per point.
+func linearFit(p Potential, y []float64, x ...[]float64) ([]float64, error) {
+	npar := len(p.ParNames())
+	if len(y) < npar {
+		return nil, fmt.Errorf("only %d points to fit %d parameters", len(y), npar)
+	}
+	A := mat.NewDense(len(y), npar, nil)
+	row := make([]float64, npar)
+	pt := make([]float64, len(x))
+	for i := range y {
+		for j, w := range x {
+			pt[j] = w[i]
 		}
-		return r2 / (2 * float64(len(x)))
-	}
-	ngrad := func(g, par []float64) {
-		g = fd.Gradient(g, score, par, &fd.Settings{Formula: fd.Central})
+		p.Deriv(row, nil, pt...)
+		A.SetRow(i, row)
 	}
-	nhess := func(hess *mat.SymDense, par []float64) {
-		fd.Hessian(hess, score, par, nil)
+	var svd mat.SVD
+	if ok := svd.Factorize(A, mat.SVDThin); !ok {
+		return nil, fmt.Errorf("SVD factorization failed")
 	}
-	guess := ryckBelleGuess(x, y)
-	iterations := -1 //tell the Fit function to use it's default
-	ret, res := Fit(score, ngrad, nhess, guess, iterations)
+	var sol mat.VecDense
+	svd.SolveVecTo(&sol, mat.NewVecDense(len(y), y), svd.Rank(1e-10))
+	return sol.RawVector().Data, nil
+}
 
-	return ret, math.Sqrt(2 * res)
+//The equilibrium value is taken from the minimum of the energy, folded to [0,pi], as the potential
+//depends only on its cosine. With that, the energy is linear in k, which is obtained by least squares.
+func restrictedTorsionGuess(x, y []float64) []*float64 {
+	eq := x[floats.MinIdx(y)]
+	eq = math.Acos(math.Cos(eq))
+	ceq := math.Cos(eq)
+	num, den := 0.0, 0.0
+	for i, v := range x {
+		s2 := math.Pow(math.Sin(v), 2)
+		if s2 < 1e-6 {
+			continue
+		}
+		f := 0.5 * math.Pow(math.Cos(v)-ceq, 2) / s2
+		num += y[i] * f
+		den += f * f
+	}
+	k := 1.0
+	if den > 0 && num > 0 {
+		k = num / den
+	}
+	return []*float64{&eq, &k}
 }
 
 //yeah, only for consistency. I won't even try to get cute here.
@@ -412,47 +322,3 @@ func ryckBelleGuess(x, y []float64) []*float64 {
 	}
 	return guess
 }
-
-/************************
-*
-The  master fit function
-*
-*************************/
-
-func Fit(score func([]float64) float64, grad func([]float64, []float64), hess func(*mat.SymDense, []float64), guessp []*float64, iter int) ([]float64, float64) {
-	prob := optimize.Problem{Func: score, Grad: grad, Hess: hess}
-	guess := make([]float64, len(guessp))
-	for i, v := range guessp {
-		if v == nil {
-			guess[i] = 1 //as good a default guess as any, I suppose.
-		} else {
-			guess[i] = *v
-		}
-	}
-	if iter <= 0 {
-		iter = 10000000
-	}
-	//I could add flags to control these parameters also.
-	conv := optimize.FunctionConverge{Iterations: iter}
-	//	gradient := 0.000001
-	ret, err := optimize.Minimize(prob, guess, &optimize.Settings{Converger: &conv, Concurrent: 4}, &optimize.Newton{})
-	if err == nil {
-		LogV(2, ret.X, ret.F, "Iterations", ret.MajorIterations)
-
-		return ret.X, ret.F
-
-	}
-	conv = optimize.FunctionConverge{Absolute: 1e-5, Iterations: iter}
-
-	for gradient := 0.000001; gradient <= 0.01; gradient = gradient * 5.0 {
-		LogV(2, "failed!", ret.X, ret.F, ret.MajorIterations, "will try now gradient:", gradient)
-		ret, err := optimize.Minimize(prob, ret.X, &optimize.Settings{GradientThreshold: gradient, Converger: &conv, Concurrent: 4}, &optimize.Newton{})
-		if err == nil {
-			LogV(2, ret.X, ret.F, "Iterations", ret.MajorIterations)
-			return ret.X, ret.F
-
-		}
-	}
-	return guess, 999999.9 //a very large number to signal that things didn't work
-	//panic(err.Error()) //we tried, but couldn't
-}
@@ -1,5 +1,5 @@
 /*
- * main.go, part of Bartender
+ * gromacs_printer.go, part of Bartender
  *
  *
  * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
@@ -28,131 +28,125 @@ package main
 
 import (
 	"fmt"
-	"math"
 	"os"
 )
 
-//This seems like a good easy-to-implement compromise.
-const const_cutoff0 float64 = 20000
-const const_cutoff1 float64 = 25000
-const const_cutoff2 float64 = 50000
-
-func PrintBonded(params map[string][]*bonded, outname string) {
+//PrintBonded writes the parameters in params to the itp file outname. The lines in header, if any, are written as comments
+//at the beginning of the file. The bonds marked as constraints (see ApplyConstraintPolicy) are written in the constraints
+//section, and also as commented bonds, if their force constants are lower than the maximum in P. Bonds with force constants of
+//at least the comment threshold in P are also written as commented constraints. The beads are written to the atoms section,
+//with the types suggested in types (see SuggestBeadTypes). The virtual sites in vs, if any, are written after the bonded interactions.
+func PrintBonded(params map[string][]*bonded, types []*BeadType, vs []*VirtualSite, outname string, header []string, P *ConstraintPolicy) {
 	fout, err := os.Create(outname)
 	if err != nil {
 		panic(err.Error())
 	}
 	fout.WriteString("; Topology by Bartender - www.github.com/rmera/bartender\n")
 	fout.WriteString("; Please cite the Bartender reference: XXXXXXXXXXX\n")
+	for _, v := range header {
+		fout.WriteString("; " + v + "\n")
+	}
+
+	//atoms
+	fout.WriteString("[atoms]\n; nr type   resnr residue atom cgnr charge  mass ; suggested type\n")
+	for i, v := range types {
+		fout.WriteString(fmt.Sprintf("%3d  %-6s  1  %-5s  B%-3d %3d  %4.1f  %5.1f ; %s\n", i+1, v.Type(), v.residue, i+1, i+1, v.Charge(), v.Mass(), v.Text()))
+	}
 
 	//bonds
 	fout.WriteString("[bonds]\n; i j  funct    length   force.c.\n")
 	for _, v := range params["bonds"] {
-		eq := v.params[0]
-		k := v.params[1]
-		rmsd := v.rmsd
+		if v.err != nil {
+			fout.WriteString(v.Line())
+			continue
+		}
 		str := v.Comment()
-		if k >= const_cutoff1 {
-			str += ";"
-			if k >= const_cutoff2 {
+		if v.constraint {
+			if v.built {
+				continue
+			}
+			if v.params[1] >= P.max {
+				LogV(1, fmt.Sprintf("The bond between beads %s is written only as a constraint", BeadsText(v.beads)))
 				continue
 			}
+			str += ";"
 		}
-		str += fmt.Sprintf("%3d %-3d 1      %5.3f     %8.2f ; rmsd: %8.2f\n", v.beads[0]+1, v.beads[1]+1, eq, k, rmsd)
-		fout.WriteString(str)
+		fout.WriteString(str + v.pot.ITP(v))
 	}
 
 	//constraints
 	fout.WriteString("[constraints]\n; i j  funct    length  \n")
 	for _, v := range params["bonds"] {
-		eq := v.params[0]
-		k := v.params[1]
-		rmsd := v.rmsd
+		if v.err != nil {
+			continue //already reported in the bonds section
+		}
 		str := v.Comment()
-		if k < const_cutoff1 {
-			str += ";"
-			if k < const_cutoff0 {
+		if !v.constraint {
+			if v.params[1] < P.comment {
 				continue
 			}
+			str += ";"
 		}
-		str += fmt.Sprintf("%3d %-3d 1      %5.3f     %8.2f ; rmsd: %8.2f\n", v.beads[0]+1, v.beads[1]+1, eq, k, rmsd)
-		fout.WriteString(str)
+		fout.WriteString(str + v.pot.ITP(v))
 	}
 
 	//angles
-	strCos := ""
 	fout.WriteString("[angles]\n; i     j       k       funct   angle   force_constant\n")
-	for _, v := range params["angles"] {
-		if v.functype == 1 {
-			eq := v.params[0]
-			k := v.params[1]
-			b := v.beads
-			str := fmt.Sprintf("%s%3d     %-3d     %-3d       %2d     %5.2f  %8.2f ; rmsd: %8.2f\n", v.Comment(), b[0]+1, b[1]+1, b[2]+1, v.functype, eq, k, v.rmsd)
-			fout.WriteString(str)
-
-		}
-		if v.functype == 2 {
-			//Now the parameters for the Cos angle fit.
-			eqcos := v.params[0]
-			kcos := v.params[1]
-			b := v.beads
-			strCos += fmt.Sprintf("%s%3d     %-3d     %-3d       %2d     %5.2f  %8.2f ; Harmonic-Cos (Gromos96) potential rmsd: %8.2f\n", v.Comment(), b[0]+1, b[1]+1, b[2]+1, v.functype, eqcos, kcos, v.rmsd)
-		}
-
-	}
-	fout.WriteString(strCos) //After processing the dihedrals, we print the alternative, Cos-Angle fit for all the angles (commented out).
+	writeByPotential(fout, params, "angles")
 
 	//angles
-	//got to make changes here
 	fout.WriteString("[angles]\n; i     j       k       funct   angle   force_constant\n")
 	fout.WriteString("; ReB\n")
-	for _, v := range params["reb"] {
-		eq := v.params[0]
-		k := v.params[1]
-		b := v.beads
-		str := fmt.Sprintf("%s%3d     %-3d     %-3d       %2d     %5.2f  %8.2f ; rmsd: %8.2f \n", v.Comment(), b[0]+1, b[1]+1, b[2]+1, v.functype, eq, k, v.rmsd)
-		fout.WriteString(str)
-
-	}
+	writeByPotential(fout, params, "reb")
 
 	//dihedrals
 	fout.WriteString("[dihedrals]\n; i     j       k    l       funct   phase       kd    pn\n")
-	str2 := ""
-	str3 := ""
-	for _, v := range params["dihe"] {
-		if v.functype == 1 {
-			eq := v.params[0]
-			k := v.params[1]
-			n := int(math.Round(v.params[2]))
-			b := v.beads
-			str := fmt.Sprintf("%s%3d     %-3d     %-3d  %-3d       %2d     %5.2f  %8.2f   %1d ; rmsd: %8.2f\n", v.Comment(), b[0]+1, b[1]+1, b[2]+1, b[3]+1, v.functype, eq, k, n, v.rmsd)
-			fout.WriteString(str)
-		}
-		if v.functype == 3 {
-			p := v.params
-			b := v.beads
-			str2 += fmt.Sprintf("%s%3d     %-3d     %-3d  %-3d       %2d     %5.2f %5.2f %5.2f %5.2f %5.2f %5.2f ;; Ryckaert-Belleman's potential. rmsd: %8.2f \n", v.Comment(), b[0]+1, b[1]+1, b[2]+1, b[3]+1, v.functype, p[0], p[1], p[2], p[3], p[4], p[5], v.rmsd)
-		}
-		if v.functype == 11 {
-			p := v.params
-			b := v.beads
-			str3 += fmt.Sprintf("%s%3d     %-3d     %-3d  %-3d       %2d     %5.2f %5.2f %5.2f %5.2f %5.2f  %5.2f ;; Combined bending-torsion potential. rmsd: %8.2f \n", v.Comment(), b[0]+1, b[1]+1, b[2]+1, b[3]+1, v.functype, p[0], p[1], p[2], p[3], p[4], p[5], v.rmsd)
-		}
-
-	}
-	fout.WriteString(str2) //After processing the dihedrals, we print the alternative, R-B fit for all the angles
-	fout.WriteString(str3) //After processing the dihedrals, we print the alternative, Combined B-T fit for all the angles (commented out).
+	//After the preferred potential for the dihedrals, we print the alternatives, R-B and combined B-T fits.
+	writeByPotential(fout, params, "dihe")
 
 	//improper
 	fout.WriteString(";Improper \n; i     j       k    l       funct   angle       kd    \n")
-	for _, v := range params["improp"] {
-		eq := v.params[0]
-		k := v.params[1]
-		b := v.beads
-		//	n := int(math.Round(param["dihe"][i][2]))
-		str := fmt.Sprintf("%s%3d     %-3d     %-3d  %-3d       %2d     %5.2f  %8.2f ; rmsd: %8.2f   \n", v.Comment(), b[0]+1, b[1]+1, b[2]+1, b[3]+1, v.functype, eq, k, v.rmsd)
-		fout.WriteString(str)
-
+	writeByPotential(fout, params, "improp")
+
+	//virtual sites
+	sections := map[string]string{"virtual_sites3": "; site  i   j   k  funct   a   b  (c)\n", "virtual_sitesn": "; site funct  constructing beads and weights\n"}
+	for _, sec := range []string{"virtual_sites3", "virtual_sitesn"} {
+		header := "[" + sec + "]\n" + sections[sec]
+		for _, v := range vs {
+			if (v.funct == 3) == (sec == "virtual_sitesn") {
+				fout.WriteString(header + v.Line())
+				header = ""
+			}
+		}
 	}
 	fout.Close()
 }
+
+//Constrained returns true if the bond b is written as a constraint in the itp file.
+func Constrained(b *bonded) bool {
+	return b.err == nil && b.constraint
+}
+
+//UsedBonded returns the interactions of the kind k that are used in the topology, that is,
+//those that were successfully fitted and are not commented out.
+func UsedBonded(params map[string][]*bonded, k string) []*bonded {
+	ret := make([]*bonded, 0, len(params[k]))
+	for _, v := range params[k] {
+		if v.err == nil && !v.commented {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+//writeByPotential writes the itp lines for all the interactions of the kind k in params.
+//the interactions are grouped by potential, in the order the potentials were registered.
+func writeByPotential(fout *os.File, params map[string][]*bonded, k string) {
+	for _, p := range Potentials(k) {
+		for _, v := range params[k] {
+			if v.pot == p {
+				fout.WriteString(v.Line())
+			}
+		}
+	}
+}
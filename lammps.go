@@ -0,0 +1,237 @@
+/*
+ * lammps.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+)
+
+//The empty space, in A, left between the beads and the faces of the simulation box in the LAMMPS data file.
+const lammpsMargin = 15.0
+
+//The LAMMPS section for each kind of interaction, in the order they are written.
+var lammpsKinds = []struct {
+	section string
+	kinds   []string
+}{
+	{"bond", []string{"bonds"}},
+	{"angle", []string{"angles", "reb"}},
+	{"dihedral", []string{"dihe"}},
+	{"improper", []string{"improp"}},
+}
+
+//One interaction, as written to the LAMMPS files. Each interaction has its own type.
+type lammpsTerm struct {
+	b      *bonded
+	style  string
+	coeffs []float64
+}
+
+//LAMMPSCoeffs returns the LAMMPS style, and its coefficients, in "real" units (kcal/mol, A, degrees),
+//equivalent to the potential fitted for b. Note that, unlike GROMACS, LAMMPS doesn't
+//include a factor of 1/2 in its harmonic potentials.
+func LAMMPSCoeffs(b *bonded) (string, []float64, error) {
+	p := b.params
+	e := chem.KJ2Kcal
+	switch fmt.Sprintf("%s%d", b.pot.Kind(), b.pot.FuncType()) {
+	case "bonds1":
+		//kJ/mol/nm^2 to kcal/mol/A^2
+		return "harmonic", []float64{0.5 * p[1] * e / 100, p[0] * 10}, nil
+	case "angles1", "improp2":
+		return "harmonic", []float64{0.5 * p[1] * e, p[0]}, nil
+	case "angles2":
+		return "cosine/squared", []float64{0.5 * p[1] * e, p[0]}, nil
+	case "reb10", "dihe10":
+		return "cosine/squared/restricted", []float64{0.5 * p[1] * e, p[0]}, nil
+	case "dihe1":
+		return "fourier", []float64{1, p[1] * e, math.Round(p[2]), p[0]}, nil
+	case "dihe3":
+		//GROMACS uses the polymer convention (psi=phi-180) for the R-B potential, LAMMPS doesn't,
+		//so the odd terms change sign.
+		ret := []float64{float64(len(p))}
+		for i, v := range p {
+			ret = append(ret, math.Pow(-1, float64(i))*v*e)
+		}
+		return "nharmonic", ret, nil
+	}
+	return "", nil, fmt.Errorf("The %s potential has no equivalent in LAMMPS", b.pot.Name())
+}
+
+//lammpsSelected returns the interactions of the given kinds that are used in the GROMACS topology
+//(the successful, non commented ones) with their LAMMPS styles. Those without a LAMMPS equivalent are reported and left out.
+func lammpsSelected(params map[string][]*bonded, kinds []string) []*lammpsTerm {
+	ret := make([]*lammpsTerm, 0, 10)
+	for _, k := range kinds {
+		for _, v := range UsedBonded(params, k) {
+			style, coeffs, err := LAMMPSCoeffs(v)
+			if err != nil {
+				LogV(0, fmt.Sprintf("%s for beads %s not exported to LAMMPS: %s", CategoryName(k), BeadsText(v.beads), err.Error()))
+				continue
+			}
+			ret = append(ret, &lammpsTerm{b: v, style: style, coeffs: coeffs})
+		}
+	}
+	return ret
+}
+
+//PrintLAMMPS writes the interactions in params used in the GROMACS topology, to a LAMMPS data file, dataname, and a file with the corresponding
+//styles and coefficients, coeffname, to be included in a LAMMPS input after reading the data file. The beads are placed at their (weighted) centers
+//in the coordinates coord, and each gets its own atom type, with the mass of the atoms it contains. Each interaction also gets its own type.
+//All quantities are in LAMMPS "real" units. The lines in header, if any, are written as comments at the beginning of the coefficients file.
+//Since this is not really needed, it doesn't panic.
+func PrintLAMMPS(params map[string][]*bonded, coord *v3.Matrix, mol chem.Atomer, beads [][]int, weights [][]float64, dataname, coeffname string, header []string) error {
+	terms := make([][]*lammpsTerm, len(lammpsKinds))
+	for i, v := range lammpsKinds {
+		terms[i] = lammpsSelected(params, v.kinds)
+	}
+	pos := make([][3]float64, len(beads))
+	lo := [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+	hi := [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for i, v := range beads {
+		c := WCOM(coord, mol, v, weights[i])
+		for j := range pos[i] {
+			pos[i][j] = c.At(0, j)
+			lo[j] = math.Min(lo[j], pos[i][j])
+			hi[j] = math.Max(hi[j], pos[i][j])
+		}
+	}
+
+	fout, err := os.Create(dataname)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	fout.WriteString("LAMMPS data file by Bartender - www.github.com/rmera/bartender\n\n")
+	fout.WriteString(fmt.Sprintf("%d atoms\n", len(beads)))
+	for i, v := range lammpsKinds {
+		if len(terms[i]) > 0 {
+			fout.WriteString(fmt.Sprintf("%d %ss\n", len(terms[i]), v.section))
+		}
+	}
+	fout.WriteString(fmt.Sprintf("\n%d atom types\n", len(beads)))
+	for i, v := range lammpsKinds {
+		if len(terms[i]) > 0 {
+			fout.WriteString(fmt.Sprintf("%d %s types\n", len(terms[i]), v.section))
+		}
+	}
+	fout.WriteString("\n")
+	for j, v := range []string{"x", "y", "z"} {
+		fout.WriteString(fmt.Sprintf("%10.4f %10.4f %slo %shi\n", lo[j]-lammpsMargin, hi[j]+lammpsMargin, v, v))
+	}
+	fout.WriteString("\nMasses\n\n")
+	for i, v := range beads {
+		mass := 0.0
+		for j, w := range v {
+			mass += mol.Atom(w).Mass * weights[i][j]
+		}
+		fout.WriteString(fmt.Sprintf("%3d %8.3f # bead %d\n", i+1, mass, i+1))
+	}
+	fout.WriteString("\nAtoms # molecular\n\n")
+	for i, v := range pos {
+		fout.WriteString(fmt.Sprintf("%3d 1 %3d %10.4f %10.4f %10.4f\n", i+1, i+1, v[0], v[1], v[2]))
+	}
+	for i, v := range lammpsKinds {
+		if len(terms[i]) == 0 {
+			continue
+		}
+		fout.WriteString(fmt.Sprintf("\n%ss\n\n", strings.Title(v.section)))
+		for j, t := range terms[i] {
+			fout.WriteString(fmt.Sprintf("%3d %3d", j+1, j+1))
+			for _, b := range t.b.beads {
+				fout.WriteString(fmt.Sprintf(" %3d", b+1))
+			}
+			fout.WriteString("\n")
+		}
+	}
+
+	cout, err := os.Create(coeffname)
+	if err != nil {
+		return err
+	}
+	defer cout.Close()
+	cout.WriteString("# LAMMPS styles and coefficients by Bartender - www.github.com/rmera/bartender\n")
+	cout.WriteString("# Please cite the Bartender reference: XXXXXXXXXXX\n")
+	for _, v := range header {
+		cout.WriteString("# " + v + "\n")
+	}
+	cout.WriteString(fmt.Sprintf("# Use with \"units real\" and \"atom_style molecular\", after \"read_data %s\"\n", dataname))
+	for i, v := range lammpsKinds {
+		if len(terms[i]) == 0 {
+			continue
+		}
+		//Several styles in the same section require the hybrid style, and the style in each coefficient line.
+		styles := make([]string, 0, 2)
+		for _, t := range terms[i] {
+			if !containsString(styles, t.style) {
+				styles = append(styles, t.style)
+			}
+		}
+		hybrid := len(styles) > 1
+		if hybrid {
+			cout.WriteString(fmt.Sprintf("\n%s_style hybrid %s\n", v.section, strings.Join(styles, " ")))
+		} else {
+			cout.WriteString(fmt.Sprintf("\n%s_style %s\n", v.section, styles[0]))
+		}
+		for j, t := range terms[i] {
+			line := fmt.Sprintf("%s_coeff %3d", v.section, j+1)
+			if hybrid {
+				line += " " + t.style
+			}
+			for _, c := range t.coeffs {
+				line += fmt.Sprintf(" %.6g", c) //integers (multiplicities, number of terms) must be written as such.
+			}
+			cout.WriteString(fmt.Sprintf("%s # beads%s, %s, rmsd: %.2f\n", line, BeadsText(t.b.beads), t.b.pot.Name(), t.b.rmsd))
+		}
+	}
+	//The bonds that go to the constraints section of the itp.
+	constr := make([]string, 0, 2)
+	for j, t := range terms[0] {
+		if Constrained(t.b) {
+			constr = append(constr, fmt.Sprintf("%d", j+1))
+		}
+	}
+	if len(constr) > 0 {
+		cout.WriteString(fmt.Sprintf("\n# The bonds of types %s are constraints in the GROMACS topology. To constrain them here too:\n", strings.Join(constr, " ")))
+		cout.WriteString(fmt.Sprintf("# fix constraints all shake 0.0001 20 0 b %s\n", strings.Join(constr, " ")))
+	}
+	return nil
+}
+
+func containsString(s []string, test string) bool {
+	for _, v := range s {
+		if v == test {
+			return true
+		}
+	}
+	return false
+}
@@ -31,10 +31,14 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
 	"gonum.org/v1/gonum/stat"
 )
 
@@ -51,15 +55,32 @@ func LogV(level int, d ...interface{}) {
 }
 
 func main() {
+	//The compare mode has its own flags.
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		CompareMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "map" {
+		MapMain(os.Args[2:])
+		return
+	}
 	//There will be _tons_ of flags, but they are meant not to be needed the 99% of the time.
 	avsasaskip := flag.Int("avsasaskip", 1, "If averaged-SASAs are requested, read only every nth frames of the trajectory")
+	mapping := flag.String("mapping", "", "Read the beads from this mapping file, in the backward (.map) or vermouth/martinize2 (.mapping) format, instead of the BEADS section of the input file")
+	sasa := flag.Bool("sasa", false, "Compare the trajectory-averaged SASAs and volumes of the atomistic and CG models, and find the factor by which the bond lengths should be scaled for the SASAs to match")
+	scalebonds := flag.Bool("scaleBonds", false, "With -sasa, scale the bond lengths in the output by the factor found")
 	cpus := flag.Int("cpus", -1, "the total CPUs used for the QM calculations. If a number <0 is given, all logical CPUs are used")
-	refit := flag.Bool("refit", false, "Only do a re-fit for the bonded parameters from an existing trajectory. Equivalent to -time 1 -nobeadtype")
+	refit := flag.Bool("refit", false, "Only do a re-fit for the bonded parameters from the trajectory of the previous run in the work directory (see -workdir). Equivalent to -time -1")
 	noplot := flag.Bool("noplot", false, "Do not produce the plots that would normally be written for each parameter fitted")
 	owntraj := flag.String("owntraj", "", "Use the given trajectory for geometry analysis, instead of obtaining a GFN one. DCD, multi-PDB and multi-XYZ formats are allowed. XTC is allowed if the xdrfile library is installed")
 	verbose := flag.Int("verbose", 0, "Print lots of additional information (mostly for debugging)")
-	mdtime := flag.Int("time", 1000, "the total simulation time, in ps. If a number <0 is given, the MD will not be performed, and a previous trajectory will be used (the program will crash if no such previous trajectory is present)")
+	mdtime := flag.Int("time", 1000, "the total simulation time, in ps. If a number <0 is given, the MD will not be performed, and the trajectory of the previous run in the work directory (see -workdir) will be used")
 	charge := flag.Int("charge", 0, "the total charge of the system, in a.u. Needed for partial charges calculation")
+	multi := flag.Int("multiplicity", 1, "the spin multiplicity of the system (2 for radicals with one unpaired electron)")
+	step := flag.Float64("step", 0, "the time step for the MD, in fs. If 0 or less, the xtb default for the method is used (2 fs for gfnff, 4 fs for the others)")
+	dump := flag.Float64("dump", 50, "the time between the frames written to the MD trajectory, in fs")
+	hmass := flag.Float64("hmass", 4, "the mass of the hydrogen atoms in the MD, in amu. Larger masses allow longer time steps")
+	shake := flag.Int("shake", -1, "SHAKE constraints in the MD: 0, none, 1, bonds to hydrogen, 2, all bonds. If a negative number is given, the default for the method is used (0 for gfnff, 2 for the others)")
 	dcdsave := flag.String("dcdSave", "", "If given, Bartender will save the xtb-calculated trajectory in DCD format with the filename given")
 	method := flag.String("method", "gfnff", "The method employed in the semiempirical simulation. Valid options are gfn0, gfn1,gfn2 and gfnff")
 	temperature := flag.Float64("temperature", 298, "The temperature for the MD simulation, in K")
@@ -67,13 +88,36 @@ func main() {
 	ai := flag.Float64("angleIcrcement", 1, "The bin width for the A-B-C angle histograms, in degrees")
 	di := flag.Float64("dihedralIncrement", 10, "The bin width for the A-B-C-D dihedral histograms, in degrees")
 	ii := flag.Float64("improperIncrement", 1, "The bin width for the A-B-C-D improper dihedral histograms, in degrees")
-	dielectric := flag.Float64("dielectric", 21.0, "The dielectric constant for continuum solvent in QM calculations. Only some values are allowed (see code) -1 for vacuum calculations. Default is acetone")
+	dielectric := flag.Float64("dielectric", 21.0, "The dielectric constant for continuum solvent in QM calculations. The available solvent with the nearest dielectric constant is used. -1 for vacuum calculations. Default is acetone. Ignored if -solvent is given")
+	solventnames := flag.String("solvent", "", "The implicit solvent(s) for the MD, by name. Any ALPB solvent available in xtb, or vac for vacuum calculations. Several solvents can be given, separated by commas. In that case, an MD is performed, and the parameters are fitted, for each, and a comparison is written to solvents.tsv")
 	replicas := flag.Int("replicas", 0, "Number of replicas in a replica-exchange MD simulation, if performed. If less or equal zero, Bartender will come up with a reasonable number")
 	maxtemp := flag.Float64("maxtemp", 400.0, "The maximum temperature allowed for a replica in a replica-exchange simulation, if performed")
-	exfreq := flag.Int("exfreq", 2, "The frequency of attempted replica exchanges in a replica-exchange simulation, if performed")
+	exfreq := flag.Int("exfreq", 2, "The time between attempted replica exchanges, in ps, in a replica-exchange simulation, if performed")
+	criterion := flag.String("criterion", "aic", "The information criterion used to select among the potentials fitted for an interaction. Valid options are aic and bic")
+	seed := flag.Int64("seed", 1, "The seed for the random starting points of the fits. The same seed will always produce the same parameters")
+	starts := flag.Int("starts", 6, "The number of starting points tried for each fit. The first one is always the initial guess")
+	iterations := flag.Int("iterations", 10000, "The maximum number of iterations for each minimization in the fits")
+	replicalist := flag.String("replicaList", "", "A file with one line per replica of a replica-exchange simulation, with its temperature (K) and its trajectory (multi-XYZ, with the energies in the comment lines, as written by xtb). The frames of all replicas are analyzed, reweighted with MBAR to the temperature given by -temperature. No MD is performed")
+	couplingthres := flag.Float64("coupling", 0.5, "Pairs of degrees of freedom with a correlation, or normalized mutual information, of at least this value, are reported as strongly coupled")
+	fes := flag.Bool("fes", false, "Write the 2D free energy surfaces for the pairs of degrees of freedom reported as strongly coupled")
+	workdir := flag.String("workdir", "", "The directory where the MD is run, and its manifest written. By default, bartender_ followed by the name of the geometry file, without extension. An interrupted MD in it is resumed, and -refit uses its trajectory")
+	preopt := flag.Bool("preopt", false, "Optimize the geometry with xtb before the MD")
+	conformers := flag.Int("conformers", 0, "If larger than 0, a conformer search (metadynamics with xtb) is performed before the MD, and this number of the lowest conformers found are used to start independent MD runs, which share the total simulation time. Their trajectories are merged")
+	seeds := flag.Int("seeds", 1, "The number of independent MD runs, with different seeds, performed at the same time, sharing the CPUs and the total simulation time. Their trajectories are merged, and their distributions compared in seeds.tsv. With -conformers, the number of runs from each conformer. The starting coordinates of every run but the first are slightly displaced, from the seed. With xtb, which ignores the seed, that displacement is the only difference between the runs")
+	enginename := flag.String("engine", "xtb", "The program used for the MD. Valid options are xtb and mock. The latter is a simple elastic network model that needs no external program, meant only for testing")
+	lammps := flag.Bool("lammps", false, "Also write the topology in LAMMPS format: a data file with the beads at their positions in the geometry given, and the corresponding styles and coefficients")
+	openmm := flag.Bool("openmm", false, "Also write the bonded interactions as an OpenMM ForceField XML file, with a residue template for the beads")
+	defconstr := DefaultConstraintPolicy()
+	constrmode := flag.String("constraints", "threshold", "Which bonds are written as constraints. threshold: those with force constants of at least -constraintK; none; all; rings: as threshold, but the ring systems whose bonds are all stiffer than -ringK are made rigid, as in Martini 3, with a hinge of 4 constrained beads and an improper dihedral, and the other beads as virtual sites")
+	constrk := flag.Float64("constraintK", defconstr.k, "Bonds with force constants of at least this value, in kJ/mol/nm^2, are written as constraints")
+	constrcomment := flag.Float64("constraintComment", defconstr.comment, "Bonds that are not constraints, with force constants of at least this value, are also written as commented constraints. Use 0 to write all of them")
+	bondmax := flag.Float64("bondMax", defconstr.max, "Constraints with force constants of at least this value are not written as commented bonds. Use inf to write all of them")
+	ringk := flag.Float64("ringK", defconstr.ringk, "With -constraints rings, ring systems whose bonds all have force constants of at least this value are made rigid")
+	hingek := flag.Float64("hingeK", defconstr.hingek, "With -constraints rings, the force constant, in kJ/mol/rad^2, of the improper dihedral that keeps the hinge of each rigid ring system flat")
+	linear := flag.Float64("linearAngle", 160, "Angles whose distributions reach this value, in degrees, are given a ReB potential, as other potentials are unstable near 180 degrees")
 
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n  %s: [flags] geomtry.pdb/.gro/.xyz bartender_input.inp \n\nFlags:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n  %s: [flags] geomtry.pdb/.gro/.xyz bartender_input.inp \n  %s compare [flags] reference.itp test.itp ... (use \"%s compare -help\" for details)\n  %s map [flags] geometry.pdb/.gro/.xyz (use \"%s map -help\" for details)\n\nFlags:\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -96,175 +140,408 @@ func main() {
 		"improp": *ii * d2r,
 	}
 
-	param := map[string][]*bonded{
-		"bonds":  make([]*bonded, 0, 0),
-		"angles": make([]*bonded, 0, 0),
-		"reb":    make([]*bonded, 0, 0),
-		"dihe":   make([]*bonded, 0, 0),
-		"improp": nil,
-	}
 	args := flag.Args()
 	geoname := args[0]
 	inpname := args[1]
 	fmt.Printf("Use:\n  $BARTENDERPATH/bartender  [FLAGS] geometry_file input_file\n Use \"bartender -help\" to see the available flags\n")
-	var mol *chem.Molecule
-	var err error
-	extension := strings.ToLower(strings.Split(geoname, ".")[1])
-	switch extension {
-	case "gro":
-		mol, err = chem.GroFileRead(geoname)
-	case "pdb":
-		mol, err = chem.PDBFileRead(geoname, false)
-	default:
-		mol, err = chem.XYZFileRead(geoname)
-	}
+	mol, err := ReadGeometry(geoname)
 	if err != nil {
 		panic(err.Error())
 	}
 	mol.SetCharge(*charge) //needed for the MD and the partial charges calculation
+	mol.SetMulti(*multi)
 	wanted, marked := ParseInputGeo(inpname)
-	MDEngine := MD
-	if len(marked) != 0 {
-		MDEngine = REMD
+	var beads [][]int
+	var weights [][]float64
+	if *mapping != "" {
+		//The mapping file replaces the BEADS section of the input.
+		beads, weights, _, err = ReadMapping(*mapping, mol)
+		if err != nil {
+			panic(err.Error())
+		}
+	} else {
+		beads, weights = ParseInputBead(inpname)
+	}
+	vsites := ParseInputVirtual(inpname, len(beads))
+	wanted, marked = ExcludeVirtual(wanted, marked, vsites)
+	types := SuggestBeadTypes(mol.Coords[0], mol, beads, weights, vsites)
+	CheckBeadCharges(types, mol.Charge())
+	for _, v := range types {
+		LogV(1, fmt.Sprintf("Bead %d: %s", v.bead+1, v.Text()))
 	}
-	beads, weights := ParseInputBead(inpname)
 	LogV(2, wanted, "beads:", beads, "weights:", weights)
 	//bonded parameters
 	MakePDB(mol.Coords[0], mol, beads)
-	MDS := &MDSettings{time: *mdtime, method: *method, temp: *temperature, dielectric: *dielectric, cpus: *cpus, replicas: *replicas, maxtemp: *maxtemp, exfreq: *exfreq}
+	MDS := &MDSettings{time: *mdtime, method: *method, temp: *temperature, cpus: *cpus, replicas: *replicas, maxtemp: *maxtemp, exfreq: *exfreq, seed: *seed, preopt: *preopt, conformers: *conformers, seeds: *seeds, step: *step, dump: *dump, hmass: *hmass, shake: *shake}
+	MDS.SetDefaults()
+	FS := &FitSettings{increments: increments, temp: *temperature, noplot: *noplot, criterion: strings.ToLower(*criterion), linear: *linear * d2r}
+	FS.opt = &OptSettings{seed: *seed, starts: *starts, iterations: *iterations}
+	R := &RunSettings{geoname: geoname, inpname: inpname, workdir: *workdir, engine: *enginename, owntraj: *owntraj, replicalist: *replicalist, dcdsave: *dcdsave, lammps: *lammps, openmm: *openmm, sasa: *sasa, sasaskip: *avsasaskip, scalebonds: *scalebonds, coupling: *couplingthres, fes: *fes, MD: MDS, Fit: FS}
+	R.wanted, R.marked = wanted, marked
+	R.constraints = &ConstraintPolicy{mode: strings.ToLower(*constrmode), k: *constrk, comment: *constrcomment, max: *bondmax, ringk: *ringk, hingek: *hingek}
+	if err := R.constraints.Check(); err != nil {
+		panic(err.Error())
+	}
+	R.beads, R.weights, R.vsites, R.types = beads, weights, vsites, types
+	//Each run has its own work directory, with a manifest that records what was done.
+	if R.workdir == "" {
+		R.workdir = DefaultWorkDir(geoname)
+	}
+	solvents, err := ParseSolvents(*solventnames, *dielectric)
+	if err != nil {
+		panic(err.Error())
+	}
+	if len(solvents) == 1 {
+		MDS.solvent = solvents[0].name
+		RunBartender(mol, R)
+		fmt.Println("\nYour Martini, Mr. Bond.")
+		return
+	}
+	//Several solvents. Each one gets its own sub-directory of the work directory, where all its files are written.
+	if *owntraj != "" || *replicalist != "" {
+		panic("Several solvents can only be used when Bartender runs the MD")
+	}
+	for _, v := range []*string{&R.geoname, &R.inpname, &R.workdir} {
+		if *v, err = filepath.Abs(*v); err != nil {
+			panic(err.Error())
+		}
+	}
+	top, err := os.Getwd()
+	if err != nil {
+		panic(err.Error())
+	}
+	results := make(map[string]map[string][]*bonded)
+	for _, v := range solvents {
+		fmt.Printf("\nSolvent: %s (dielectric constant: %.2f)\n", v.name, v.eps)
+		S := *R
+		MD := *MDS
+		MD.solvent = v.name
+		S.MD = &MD
+		S.workdir = filepath.Join(R.workdir, v.name)
+		if err := os.MkdirAll(S.workdir, 0755); err != nil {
+			panic(err.Error())
+		}
+		if err := os.Chdir(S.workdir); err != nil {
+			panic(err.Error())
+		}
+		results[v.name] = RunBartender(mol, &S)
+		if err := os.Chdir(top); err != nil {
+			panic(err.Error())
+		}
+	}
+	SolventReport(results, solvents, "solvents.tsv")
+	fmt.Println("\nYour Martini, Mr. Bond.")
+
+}
+
+//Settings for one run of Bartender, from the MD to the fitted parameters.
+type RunSettings struct {
+	geoname     string
+	inpname     string
+	workdir     string
+	engine      string
+	owntraj     string
+	replicalist string
+	dcdsave     string
+	lammps      bool    //also write the topology in LAMMPS format
+	openmm      bool    //also write the bonded interactions as an OpenMM force field
+	coupling    float64 //threshold for the coupling analysis
+	constraints *ConstraintPolicy
+	sasa        bool //compare the atomistic and CG SASAs
+	sasaskip    int
+	scalebonds  bool //scale the bonds to match the atomistic SASA
+	fes         bool
+	wanted      map[string][][]int
+	marked      [][]int
+	beads       [][]int
+	weights     [][]float64
+	vsites      []*VirtualSite
+	types       []*BeadType //the suggested bead types
+	MD          *MDSettings
+	Fit         *FitSettings
+}
+
+//RunBartender obtains the trajectory for mol, by running the MD or reading the one given, analyzes it, and fits the bonded parameters,
+//according to R. It writes the results, and returns the fitted parameters.
+func RunBartender(mol *chem.Molecule, R *RunSettings) map[string][]*bonded {
+	MDS := R.MD
+	if err := os.MkdirAll(R.workdir, 0755); err != nil {
+		panic(err.Error())
+	}
+	MDS.dir = R.workdir
 
 	//Here we run the calculation to get a GFN0/2 trajectory, or we read whatever trajectory the user wants to supply
+	var err error
 	var mdout chem.Traj
 	var datamap map[string][][]float64
-	if true { // This "if" is for functionality that we removed temporarily, so I prefer to keep it there. Sorry about that :-)
-		if *owntraj == "" {
-			mdoutname := MDEngine(mol.Coords[0], mol, MDS) //This will take a while
-			_, mdout, err = chem.XYZFileAsTraj(mdoutname)
+	var frameweights []float64
+	var run *MDOutput
+	var manifest *Manifest
+	if R.replicalist == "" && R.owntraj == "" && MDS.time < 0 {
+		//A refit: we use the trajectory of the previous run in the same work directory.
+		manifest, err = ReadManifest(R.workdir)
+		if err != nil {
+			panic("Can't find a previous run to refit: " + err.Error())
+		}
+		if sum, _ := fileSHA256(R.geoname); sum != manifest.Geometry.SHA256 {
+			LogV(0, "The geometry file is not the one used for the MD in", R.workdir)
+		}
+		run, err = manifest.Output()
+		if err != nil {
+			panic(err.Error())
+		}
+		manifest.Command = os.Args
+		manifest.Input = ManifestFile{Name: R.inpname}
+		manifest.Outputs = nil
+	} else if R.replicalist == "" && R.owntraj == "" {
+		//If dihedrals are marked, we run a REMD. The frames from all replicas will be used, reweighted to the temperature requested.
+		engine, err := NewMDEngine(R.engine, len(R.marked) != 0)
+		if err != nil {
+			panic(err.Error())
+		}
+		manifest = NewManifest(R.workdir, R.geoname, R.inpname, engine.Name(), len(R.marked) != 0, MDS, mol)
+		prev, err := ReadManifest(R.workdir)
+		resume := err == nil && prev.Resumable(manifest)
+		if err := manifest.Write(); err != nil {
+			panic(err.Error())
+		}
+		coord := mol.Coords[0]
+		if MDS.preopt {
+			coord, err = PreOptimize(coord, mol, MDS, resume)
 			if err != nil {
 				panic(err.Error())
 			}
-		} else {
-			mdout, err = OpenTraj(*owntraj)
+		}
+		starts := []*v3.Matrix{coord}
+		if MDS.conformers > 0 {
+			starts, err = Conformers(coord, mol, MDS, MDS.conformers, resume) //This will take a while
 			if err != nil {
 				panic(err.Error())
 			}
 		}
-		datamap = TrajAn(mdout, mol, beads, weights, wanted)
-	}
-	//select which functions will be used, Go or Python
-	HookeFit := GoHookeFit
-	SimplePeriodicFit := GoSimplePeriodicFit
-	RyckBelleFit := GoRyckBelleFit
-	CosAngleFit := GoCosAngleFit
-	ReBFit := GoReBFit
+		run, err = IndependentMD(engine, starts, mol, MDS, MDS.seeds, resume) //This will take a while
+		if err != nil {
+			panic(err.Error())
+		}
+		LogV(1, run)
+		manifest.SetOutput(run)
+	} else {
+		manifest = NewManifest(R.workdir, R.geoname, R.inpname, "none", false, MDS, mol)
+		run = &MDOutput{engine: "none", trajname: R.owntraj, replicas: R.replicalist, temp: MDS.temp}
+		manifest.SetOutput(run)
+	}
+	if err := manifest.Write(); err != nil {
+		panic(err.Error())
+	}
+	R.replicalist = run.replicas
+	if R.replicalist != "" {
+		datamap, frameweights = LoadReplicas(R.replicalist, mol, R.beads, R.weights, R.wanted, MDS.temp)
+	} else { // This used to be an "if true", for functionality that we removed temporarily.
+		mdout, err = run.Traj()
+		if err != nil {
+			panic(err.Error())
+		}
+		datamap = TrajAn(mdout, mol, R.beads, R.weights, R.wanted)
+		if len(run.parts) > 1 {
+			frames, err := PartFrames(run.parts)
+			if err != nil {
+				panic(err.Error())
+			}
+			SeedReport(datamap, R.wanted, frames, "seeds.tsv", "seed_distributions.tsv")
+		}
+	}
 	fmt.Printf("All Energies in kJ/mol, distances in nm, angles in degrees\n")
+	CouplingAnalysis(datamap, R.wanted, frameweights, R.coupling, R.fes, MDS.temp, "couplings.tsv")
+	FS := R.Fit
+	FS.weights = frameweights
+	param := FitAll(datamap, R.wanted, FS)
+	ringvs, err := ApplyConstraintPolicy(param, R.constraints, mol.Coords[0], mol, R.beads, R.weights)
+	if err != nil {
+		panic(err.Error())
+	}
+	//The virtual sites of the rigid ring systems are added to those declared. R is not modified, as it may be used again for another solvent.
+	vsites, types := R.vsites, R.types
+	if len(ringvs) > 0 {
+		vsites = append(append([]*VirtualSite{}, R.vsites...), ringvs...)
+		types = make([]*BeadType, len(R.types))
+		for i, v := range R.types {
+			t := *v
+			types[i] = &t
+		}
+		for _, v := range ringvs {
+			types[v.bead].virtual = true
+		}
+	}
+	if len(vsites) > 0 {
+		if err := FitVirtualSites(vsites, run, mol, R.beads, R.weights, frameweights); err != nil {
+			panic(err.Error())
+		}
+	}
+	if R.sasa {
+		SASARun(param, run, mol, R)
+	}
+	PrintBonded(param, types, vsites, "gmx_out.itp", manifest.Header(), R.constraints)
+	PrintUncertainties(param, "gmx_out_uncertainties.tsv")
+	PrintReport(param, manifest, FS, "gmx_out.json")
+	if len(vsites) > 0 && (R.lammps || R.openmm) {
+		LogV(0, "The virtual sites are only written to the GROMACS topology")
+	}
+	if R.lammps {
+		if err := PrintLAMMPS(param, mol.Coords[0], mol, R.beads, R.weights, "lammps_out.data", "lammps_out.coeff", manifest.Header()); err != nil {
+			LogV(0, "Couldn't write the LAMMPS topology: ", err.Error())
+		}
+	}
+	if R.openmm {
+		if err := PrintOpenMM(param, mol, R.beads, R.weights, "openmm_out.xml", manifest.Header()); err != nil {
+			LogV(0, "Couldn't write the OpenMM force field: ", err.Error())
+		}
+	}
+	//	fmt.Println(datamap) //this needs to be replaced by whatever statistical analysis used to extract eq values/force constants from the distributions  in datamap
+
+	if R.owntraj == "" && run.trajname != "" && R.dcdsave != "" {
+		err = DCDSave(R.dcdsave, run.trajname)
+		if err != nil {
+			LogV(0, "Couldn't save DCD trajectory: ", err.Error()) //This always gets printed, even in non-verbose mode.
+		}
+	}
+	manifest.AddOutputs("Beads.pdb", "couplings.tsv", "seeds.tsv", "seed_distributions.tsv", "gmx_out.itp", "gmx_out_uncertainties.tsv", "gmx_out.json", "sasa.tsv", R.dcdsave)
+	if R.lammps {
+		manifest.AddOutputs("lammps_out.data", "lammps_out.coeff")
+	}
+	if R.openmm {
+		manifest.AddOutputs("openmm_out.xml")
+	}
+	if err := manifest.Write(); err != nil {
+		LogV(0, "Couldn't write the manifest: ", err.Error())
+	}
+	return param
+}
+
+//SASARun compares the SASAs and volumes of the atomistic and CG models along the trajectory of run, as requested in R,
+//and, if requested, scales the bond lengths in param.
+func SASARun(param map[string][]*bonded, run *MDOutput, mol *chem.Molecule, R *RunSettings) {
+	if run.trajname == "" {
+		LogV(0, "The SASA analysis needs a single trajectory, it can't be performed for a list of replicas")
+		return
+	}
+	traj, err := run.Traj()
+	if err != nil {
+		panic(err.Error())
+	}
+	res, err := SASAAnalysis(traj, mol, R.beads, R.weights, R.sasaskip)
+	if err != nil {
+		panic(err.Error())
+	}
+	if err := res.Write("sasa.tsv"); err != nil {
+		LogV(0, "Couldn't write the SASA results: ", err.Error())
+	}
+	if R.scalebonds && res.scale != 1 {
+		ScaleBonds(param, res.scale)
+	}
+}
+
+//Settings for the fitting of the bonded parameters.
+type FitSettings struct {
+	increments map[string]float64
+	temp       float64
+	noplot     bool
+	criterion  string  //information criterion used to select among competing potentials, "aic" or "bic"
+	linear     float64 //angle (radians) above which an angle distribution is considered to reach 180 degrees
+	opt        *OptSettings
+	weights    []float64 //weights for each frame, nil if all frames have the same weight.
+}
+
+//FitAll fits all the potentials registered for each kind of interaction to the Boltzmann-inverted
+//distributions in datamap. When more than one potential is available for an interaction, only the one selected
+//by the information criterion in S is left uncommented. It returns the fitted parameters for each kind of interaction.
+func FitAll(datamap map[string][][]float64, wanted map[string][][]int, S *FitSettings) map[string][]*bonded {
+	param := map[string][]*bonded{
+		"bonds":  make([]*bonded, 0, 0),
+		"angles": make([]*bonded, 0, 0),
+		"reb":    make([]*bonded, 0, 0),
+		"dihe":   make([]*bonded, 0, 0),
+		"improp": nil,
+	}
+	increments := S.increments
 	for k, v := range datamap {
 		for i, w := range v {
 			mean := stat.Mean(w, nil)
 			LogV(2, "\n***", k, wanted[k][i], mean, k, len(w), increments[k])
-			points, E := IBoltzmann(w, increments[k], *temperature) //doesn't return anything for now, but prints intermediate data.
+			points, E := IBoltzmann(w, increments[k], S.temp, S.weights) //doesn't return anything for now, but prints intermediate data.
 			LogV(3, "Points:", points, "\nEnergies:", E)
 			category := CategoryName(k)
 			beadst := BeadsText(wanted[k][i])
-			switch k {
-			case "dihe":
-				par, R2 := SimplePeriodicFit(points, E)
-				if par[0] < 0 {
-					LogV(1, "Dihedral corrected. Was", par[0], "became", 2*math.Pi+par[0], "Periodicity was", par[2], "Absolute value has been taken")
-					par[0] = 2*math.Pi + par[0]
-					par[2] = math.Abs(par[2])
+			fitone := func(p Potential) *bonded {
+				par, R2, err := FitPotential(p, points, E, S.opt)
+				if err != nil {
+					LogV(0, fmt.Sprintf("%s fit for the %s between beads %s failed: %s", p.Name(), category, beadst, err.Error()))
+					b := FailedBonded(i, wanted[k][i], p, err)
+					b.samples = len(w)
+					return b
 				}
-
-				LogV(3, Plot(sperf(par), points, E, fmt.Sprintf("Simple_periodic_%s", beadst), *noplot))
-				par[0] = par[0] * chem.Rad2Deg
-				comment := false
-				if R2 > 10 {
-					comment = true
-				}
-				b := NewBonded(i, wanted[k][i], par, R2, 1, comment)
-				param[k] = append(param[k], b)
-				LogV(1, fmt.Sprintf("S. Periodic. fit for the %s between  beads %s: eq: %5.3f k: %5.3f n: %5.3f Fit RMSD: %5.3f\n", category, beadst, par[0], par[1], par[2], R2))
-				par2, R22 := RyckBelleFit(points, E)
-				LogV(2, Plot(rybef(par2), points, E, fmt.Sprintf("Ryckaert-Belleman_%s", beadst), *noplot))
-				b = NewBonded(i, wanted[k][i], par2, R22, 3, !comment) //so if simple periodic was commented, whis will not, and viceversa.
-
-				LogV(1, fmt.Sprintf("Ryckaert-Bellemans fit for the %s between  beads %s: C1: %5.3f C2: %5.3f C3: %5.3f C4 %3.5f C5 %3.5f Fit RMSD: %5.3f\n", category, beadst, par2[0], par2[1], par2[2], par2[3], par2[4], R22))
-				param[k] = append(param[k], b) //[len(param[k])-1] = append(param[k][len(param[k])-1], par2...) //just one after the other
-				ia := increments["angles"]
-
-				par3, R23 := ManageBendingTorsion(datamap, wanted, i, *temperature, []float64{increments["dihe"], ia, ia})
-				//R23 should never be negative, so we'll use a negative value to signal that the fit was not obtained.
-				if R23 >= 0 {
-					//Ill add something to the log later -_-
-					b = NewBonded(i, wanted[k][i], par3, R23, 11, true)
-					param[k] = append(param[k], b)
-				} else {
-					LogV(1, fmt.Sprintf("Combined bending-torsion potential for beands %s will not be obtained, for lack of bending angles in input", beadst))
+				LogV(3, PlotPotential(p, par, points, E, beadst, S.noplot))
+				gpar := GromacsPar(p, par)
+				LogV(1, fmt.Sprintf("%s fit for the %s between  beads %s: %s Fit RMSD: %5.3f\n", p.Name(), category, beadst, ParText(p, gpar), R2))
+				b := NewBonded(i, wanted[k][i], gpar, R2, p, false)
+				b.npoints = len(points)
+				b.samples = len(w)
+				b.SetUncertainties(potentialScore(p, E, points), par, Bounds(p))
+				LogV(1, b.UncertaintyText())
+				return b
+			}
+			candidates := make([]*bonded, 0, len(Potentials(k)))
+			for _, p := range Potentials(k) {
+				if Dims(p) != 1 {
+					continue
 				}
-			case "improp":
-				par, R2 := HookeFit(points, E)
-				Plot(hookef(par), points, E, fmt.Sprintf("Improper_Hooke_%s", beadst), *noplot)
-				//par = append(par, R2)
-				LogV(1, fmt.Sprintf("Hooke fit for the %s between  beads %s: eq: %5.3f k: %5.3f Fit RMSD: %5.3f\n", category, beadst, par[0]*chem.Rad2Deg, par[1], R2))
-				par[0] = par[0] * chem.Rad2Deg
-				impropTolerance := 10.0 //degrees
-				if math.Abs(par[0]-180) < impropTolerance || math.Abs(par[0]) < impropTolerance {
-					LogV(1, "**The previous equilibrium angle will be set to 180 deg! Check that it is close enough to that value, or to 0\n")
-					par[0] = 180 //we force the improper dihedrals to be 180 degrees, to avoid a discontinuity in some of the functions
-				} else {
-					LogV(1, "**The previous equilibrium angle is too far from 180 or 0 to set it to 180 so it will")
-					LogV(1, "be left as-is. This could cause numerical problems in some functions. Check that it is what you want\n")
+				candidates = append(candidates, fitone(p))
+			}
+			//Angles that reach 180 degrees need the ReB potential, as the others are unstable there.
+			//If the ReB fit fails, we fall back to the usual selection.
+			var reb *bonded
+			if max := floats.Max(w); k == "angles" && max >= S.linear {
+				reb = fitone(PotentialFor("reb", 10))
+				param["reb"] = append(param["reb"], reb)
+				if reb.err == nil {
+					reb.note = fmt.Sprintf("ReB required: the angle distribution reaches %5.1f deg", max*chem.Rad2Deg)
+					LogV(1, fmt.Sprintf("The distribution for the %s between beads %s reaches %5.1f deg. The ReB potential will be used", category, beadst, max*chem.Rad2Deg))
+					for _, c := range candidates {
+						c.commented = true
+						c.note = "replaced by ReB"
+					}
 				}
-				b := NewBonded(i, wanted[k][i], par, R2, 2, false)
-
-				param[k] = append(param[k], b)
-
-			case "angles":
-				par, R2 := HookeFit(points, E)
-				LogV(3, Plot(hookef(par), points, E, fmt.Sprintf("Angle_Hooke_%s", beadst), *noplot))
-				par = append(par, R2)
-
-				par[0] = par[0] * chem.Rad2Deg
-				b := NewBonded(i, wanted[k][i], par, R2, 1, false)
-				param[k] = append(param[k], b)
-				LogV(1, fmt.Sprintf("Hooke fit for the %s between  beads %s: eq: %5.3f k: %5.3f Fit RMSD: %5.3f\n", category, beadst, par[0], par[1], R2))
-
-				par2, R22 := CosAngleFit(points, E)
-				par2[0] = par2[0] * chem.Rad2Deg
-				LogV(2, Plot(cosanglef(par2), points, E, fmt.Sprintf("CosAngle_%s", beadst), *noplot))
-				b = NewBonded(i, wanted[k][i], par2, R22, 2, true)
-				LogV(1, fmt.Sprintf("Cosine Angle (Gromos96) fit for the %s between  beads %s: eq: %5.3f k: %5.3f Fit RMSD: %5.3f\n", category, beadst, par2[0], par2[1], R22))
-				param[k] = append(param[k], b) //,[len(param[k])-1] = append(param[k][len(param[k])-1], par2...) //just one after the other
-
-			case "bonds":
-				par, R2 := HookeFit(points, E)
-				LogV(3, Plot(hookef(par), points, E, fmt.Sprintf("Bond_Hooke_%s", beadst), *noplot))
-				b := NewBonded(i, wanted[k][i], par, R2, 1, false)
-				param[k] = append(param[k], b)
-				LogV(1, fmt.Sprintf("Hooke fit for the %s between  beads %s: eq: %5.3f k: %5.3f Fit RMSD: %5.3f\n", category, beadst, par[0], par[1], R2))
-			case "reb":
-				par, R2 := ReBFit(points, E)
-				LogV(3, Plot(rebf(par), points, E, fmt.Sprintf("ReB_%s", beadst), *noplot))
-				par = append(par, R2)
-				par[0] = par[0] * chem.Rad2Deg
-				b := NewBonded(i, wanted[k][i], par, R2, 10, false)
+			}
+			if reb == nil || reb.err != nil {
+				SelectModel(candidates, S.criterion)
+			}
+			param[k] = append(param[k], candidates...)
+			if k != "dihe" {
+				continue
+			}
+			bt := PotentialFor("dihe", 11)
+			b, err := ManageBendingTorsion(datamap, wanted, i, S)
+			if err != nil {
+				LogV(0, fmt.Sprintf("%s fit for the %s between beads %s failed: %s", bt.Name(), category, beadst, err.Error()))
+				param[k] = append(param[k], FailedBonded(i, wanted[k][i], bt, err))
+			} else if b != nil {
+				LogV(1, fmt.Sprintf("%s fit for the %s between  beads %s: %s Fit RMSD: %5.3f\n", bt.Name(), category, beadst, ParText(bt, b.params), b.rmsd))
+				LogV(1, b.UncertaintyText())
 				param[k] = append(param[k], b)
-				LogV(1, fmt.Sprintf("Reb fit for the %s between  beads %s: eq: %5.3f k: %5.3f Fit RMSD: %5.3f\n", category, beadst, par[0], par[1], R2))
+			} else {
+				LogV(1, fmt.Sprintf("Combined bending-torsion potential for beands %s will not be obtained, for lack of bending angles in input", beadst))
 			}
 		}
 	}
-	PrintBonded(param, "gmx_out.itp")
-	//	fmt.Println(datamap) //this needs to be replaced by whatever statistical analysis used to extract eq values/force constants from the distributions  in datamap
+	return param
+}
 
-	if *owntraj == "" && *dcdsave != "" {
-		err = DCDSave(*dcdsave, "xtb.trj")
-		if err != nil {
-			LogV(0, "Couldn't save DCD trajectory: ", err.Error()) //This always gets printed, even in non-verbose mode.
-		}
+//ParText returns the names and values of the parameters par, in GROMACS units, of the potential p.
+func ParText(p Potential, par []float64) string {
+	ret := ""
+	for i, v := range p.ParNames() {
+		ret += fmt.Sprintf("%s: %5.3f ", v, par[i])
 	}
-
-	fmt.Println("\nYour Martini, Mr. Bond.")
-
+	return ret
 }
 
 func BeadsText(beads []int) string {
@@ -287,27 +564,56 @@ func CategoryName(k string) string {
 
 }
 
+//A fitted bonded interaction. The parameters are in GROMACS units.
 type bonded struct {
-	ID        int
-	beads     []int
-	params    []float64
-	rmsd      float64
-	functype  int
-	commented bool
+	ID         int
+	beads      []int
+	params     []float64
+	rmsd       float64
+	functype   int
+	pot        Potential
+	commented  bool
+	npoints    int           //the number of points used in the fit
+	samples    int           //the number of frames from which the distribution was obtained
+	note       string        //printed as a comment in the itp
+	err        error         //non-nil if the fit failed, in which case there are no parameters
+	stderr     []float64     //standard errors of the parameters, in GROMACS units
+	ci         []float64     //half-widths of the confidence intervals for the parameters, in GROMACS units
+	corr       *mat.SymDense //correlations between the parameters
+	uncerr     error         //non-nil if the uncertainties could not be obtained
+	constraint bool          //written as a constraint, see ApplyConstraintPolicy
+	built      bool          //not fitted, but built from the reference geometry (rmsd is NaN)
 }
 
-func NewBonded(ID int, beads []int, params []float64, rmsd float64, functype int, commented bool) *bonded {
+func NewBonded(ID int, beads []int, params []float64, rmsd float64, pot Potential, commented bool) *bonded {
 	ret := new(bonded)
 	ret.beads = beads
 	ret.params = params
 	ret.rmsd = rmsd
-	ret.functype = functype
+	ret.pot = pot
+	ret.functype = pot.FuncType()
 	ret.commented = commented
 	ret.ID = ID
 	return ret
 
 }
 
+//FailedBonded returns a bonded for an interaction for which the fit of the potential pot failed with the error err.
+func FailedBonded(ID int, beads []int, pot Potential, err error) *bonded {
+	ret := NewBonded(ID, beads, nil, math.NaN(), pot, true)
+	ret.err = err
+	return ret
+}
+
+//Line returns the itp line for the interaction or, if its fit failed, a comment
+//line reporting the failure.
+func (b *bonded) Line() string {
+	if b.err != nil {
+		return fmt.Sprintf(";; %s fit for beads %s failed: %s\n", b.pot.Name(), BeadsText(b.beads), b.err.Error())
+	}
+	return b.pot.ITP(b)
+}
+
 func (b *bonded) Comment() string {
 	if b.commented {
 		return ";;"
@@ -315,15 +621,57 @@ func (b *bonded) Comment() string {
 	return ""
 }
 
+//Note returns the note for the interaction, if any, prepared to be added
+//at the end of an itp line.
+func (b *bonded) Note() string {
+	if b.note == "" {
+		return ""
+	}
+	return " ; " + b.note
+}
+
 //Settings for MD. Not all these are
 //always needed.
 type MDSettings struct {
 	time       int
 	method     string
 	temp       float64
-	dielectric float64
+	solvent    string //the name of the implicit solvent, or vac
 	cpus       int
 	replicas   int
 	maxtemp    float64
-	exfreq     int
+	exfreq     int     //the time between attempted exchanges, in ps
+	seed       int64   //for the random numbers in the replica exchange, and in stochastic engines
+	dir        string  //the directory where the MD is run. The current one, if not given.
+	step       float64 //the time step, in fs
+	dump       float64 //the time between frames written to the trajectory, in fs
+	hmass      float64 //the mass of the hydrogen atoms, in amu
+	shake      int     //SHAKE mode: 0, off, 1, only bonds to hydrogen, 2, all bonds. Negative, the default for the method.
+	preopt     bool    //optimize the geometry with xtb before the MD
+	conformers int     //if larger than 0, the number of conformers, from a conformer search, used to start independent MD runs
+	seeds      int     //the number of independent MD runs, with different seeds, from each starting geometry
+}
+
+//SetDefaults fills the integration settings that are not given with the defaults of xtb, except for gfnff, for which
+//a shorter time step and no SHAKE are used, as recommended.
+func (S *MDSettings) SetDefaults() {
+	gfnff := S.method == "gfnff"
+	if S.step <= 0 {
+		S.step = 4.0
+		if gfnff {
+			S.step = 2.0
+		}
+	}
+	if S.dump <= 0 {
+		S.dump = 50.0
+	}
+	if S.hmass <= 0 {
+		S.hmass = 4.0
+	}
+	if S.shake < 0 {
+		S.shake = 2
+		if gfnff {
+			S.shake = 0
+		}
+	}
 }
@@ -0,0 +1,347 @@
+/*
+ * mapfiles.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	chem "github.com/rmera/gochem"
+	"gonum.org/v1/gonum/floats"
+)
+
+//The largest number of times a bead is repeated for an atom when a weight is written to a backward or vermouth mapping file.
+const mapMaxRepeats = 12
+
+//A mapping read from a backward or vermouth file: the bead names, in order, and, for each atom,
+//its index and name in the file, and the names of its beads.
+type mapFile struct {
+	molecule string
+	beads    []string
+	indexes  []int //1-based, as in the file
+	names    []string
+	atombead [][]string
+}
+
+//readMapFile reads a mapping file in the backward (.map) or vermouth/martinize2 (.mapping) format. Both formats are read
+//the same way: the sections [ molecule ], [ martini ] and [ atoms ] are used, and the rest ([ mapping ], [ from ], [ to ], [ chiral ], etc.)
+//are ignored. Only the first molecule in the file is read.
+func readMapFile(name string) (*mapFile, error) {
+	fin, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	ret := &mapFile{}
+	section := ""
+	molecules := 0
+	scanner := bufio.NewScanner(fin)
+	for l := 1; scanner.Scan(); l++ {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, ";#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.TrimSpace(strings.Trim(line, "[]")))
+			if section == "molecule" {
+				molecules++
+			}
+			continue
+		}
+		if molecules > 1 {
+			LogV(0, fmt.Sprintf("%s contains more than one molecule, only the first one, %s, was read", name, ret.molecule))
+			break
+		}
+		fields := strings.Fields(line)
+		switch section {
+		case "molecule":
+			ret.molecule = fields[0]
+		case "martini":
+			ret.beads = append(ret.beads, fields...)
+		case "atoms":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%s, line %d: malformed atom", name, l)
+			}
+			index, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s, line %d: malformed atom index: %s", name, l, err.Error())
+			}
+			ret.indexes = append(ret.indexes, index)
+			ret.names = append(ret.names, fields[1])
+			ret.atombead = append(ret.atombead, fields[2:])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret.indexes) == 0 {
+		return nil, fmt.Errorf("No atoms in %s", name)
+	}
+	//If there is no [ martini ] section, the beads are taken in the order in which they appear.
+	if len(ret.beads) == 0 {
+		for _, v := range ret.atombead {
+			for _, b := range v {
+				b = strings.TrimPrefix(b, "!")
+				if !containsString(ret.beads, b) {
+					ret.beads = append(ret.beads, b)
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+//ReadMapping reads the mapping in the backward or vermouth file name, for the molecule mol, and returns the atoms of each
+//bead and their weights, as ParseInputBead, and the bead names. The atoms are matched with those of mol by their names, if
+//all of them can be matched that way, and by their indexes, otherwise. An atom listed for several beads contributes to each of them
+//in proportion to the number of times the bead is listed, so an atom listed as "B1 B2" goes half to each bead, and
+//one listed as "B1 B1 B2" goes 2/3 to B1 and 1/3 to B2. A bead listed with a "!" prefix (a vermouth convention) gets the atom
+//with a weight of 0: the atom belongs to the bead, but doesn't contribute to its position. Atoms listed without beads are not mapped.
+func ReadMapping(name string, mol chem.Atomer) ([][]int, [][]float64, []string, error) {
+	m, err := readMapFile(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	atoms, err := m.match(mol)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	beads := make([][]int, len(m.beads))
+	weights := make([][]float64, len(m.beads))
+	for i, v := range m.atombead {
+		counts := make(map[string]int)
+		listed := 0
+		for _, b := range v {
+			if strings.HasPrefix(b, "!") {
+				//vermouth: the atom belongs to the bead, but doesn't contribute to its position.
+				if _, ok := counts[b[1:]]; !ok {
+					counts[b[1:]] = 0
+				}
+				continue
+			}
+			counts[b]++
+			listed++
+		}
+		for j, b := range m.beads {
+			c, ok := counts[b]
+			if !ok {
+				continue
+			}
+			w := 0.0
+			if c > 0 {
+				w = float64(c) / float64(listed)
+			}
+			beads[j] = append(beads[j], atoms[i])
+			weights[j] = append(weights[j], w)
+			delete(counts, b)
+		}
+		for b := range counts {
+			return nil, nil, nil, fmt.Errorf("%s: atom %s belongs to bead %s, not in the [ martini ] section", name, m.names[i], b)
+		}
+	}
+	for i, v := range beads {
+		if len(v) == 0 || floats.Sum(weights[i]) == 0 {
+			return nil, nil, nil, fmt.Errorf("%s: bead %s has no atoms contributing to its position", name, m.beads[i])
+		}
+		sortAtoms(v, weights[i])
+	}
+	return beads, weights, m.beads, nil
+}
+
+//match returns the 0-based index in mol of each atom in the mapping, matching them by name, if all names are found, and unique, in mol,
+//or by index, otherwise.
+func (m *mapFile) match(mol chem.Atomer) ([]int, error) {
+	byname := make(map[string]int)
+	for i := 0; i < mol.Len(); i++ {
+		n := mol.Atom(i).Name
+		if _, ok := byname[n]; ok {
+			byname[n] = -1 //repeated name
+			continue
+		}
+		byname[n] = i
+	}
+	ret := make([]int, len(m.names))
+	named := true
+	for i, v := range m.names {
+		idx, ok := byname[v]
+		if !ok || idx < 0 {
+			named = false
+			break
+		}
+		ret[i] = idx
+	}
+	if named {
+		LogV(1, "The atoms in the mapping were matched by name")
+		return ret, nil
+	}
+	for i, v := range m.indexes {
+		if v < 1 || v > mol.Len() {
+			return nil, fmt.Errorf("atom %d (%s) can't be matched by name, and its index is out of range", v, m.names[i])
+		}
+		ret[i] = v - 1
+	}
+	LogV(1, "The atoms in the mapping were matched by index")
+	return ret, nil
+}
+
+//mappingAtomNames returns the names of the atoms in mol, for a mapping file. If any atom has no name, or the names are repeated (say,
+//for molecules from XYZ files) all atoms are named after their element and index.
+func mappingAtomNames(mol chem.Atomer) []string {
+	ret := make([]string, mol.Len())
+	seen := make(map[string]bool)
+	unique := true
+	for i := range ret {
+		ret[i] = mol.Atom(i).Name
+		if ret[i] == "" || seen[ret[i]] {
+			unique = false
+		}
+		seen[ret[i]] = true
+	}
+	if !unique {
+		for i := range ret {
+			ret[i] = fmt.Sprintf("%s%d", mol.Atom(i).Symbol, i+1)
+		}
+	}
+	return ret
+}
+
+//repeats returns, for the weights of one atom in each of its beads, the number of times each bead has to be listed for the atom
+//in a backward or vermouth mapping file. If the weights can't be represented exactly, the closest representation is returned.
+//Beads with a weight of 0 get no repeats.
+func repeats(w []float64) []int {
+	total := floats.Sum(w)
+	if total == 0 {
+		return make([]int, len(w))
+	}
+	best, besterr := []int{}, math.Inf(1)
+	for n := 1; n <= mapMaxRepeats; n++ {
+		counts := make([]int, len(w))
+		err := 0.0
+		for i, v := range w {
+			counts[i] = int(math.Round(v / total * float64(n)))
+			if counts[i] < 1 && v > 0 {
+				counts[i] = 1
+			}
+		}
+		sum := 0
+		for _, c := range counts {
+			sum += c
+		}
+		for i, v := range w {
+			err += math.Abs(float64(counts[i])/float64(sum) - v/total)
+		}
+		if err < besterr-1e-9 {
+			best, besterr = counts, err
+		}
+		if besterr < 1e-9 {
+			break
+		}
+	}
+	return best
+}
+
+//WriteMapping writes the mapping given by beads and weights (as returned by ParseInputBead), for the molecule mol, to the file outname,
+//in the backward (if format is "backward") or vermouth format. Beads are named B1, B2, ..., unless names are given. Atoms shared between beads
+//are listed with each bead, repeated in proportion to the atom's weight in it. As both formats give the fraction of each atom in each of its beads,
+//the weights of a shared atom are normalized, and a warning is printed if they don't add up to one. An atom with a weight of 0 in a bead is listed with
+//the bead name prefixed by "!" in the vermouth format, and without that bead in the backward one, which has no such convention. Atoms that are not in any
+//bead are listed without beads in the backward format, and not listed in the vermouth one.
+func WriteMapping(outname, format string, mol chem.Atomer, beads [][]int, weights [][]float64, names []string) error {
+	if format != "backward" && format != "vermouth" {
+		return fmt.Errorf("Unknown mapping format: %s", format)
+	}
+	if names == nil {
+		for i := range beads {
+			names = append(names, fmt.Sprintf("B%d", i+1))
+		}
+	}
+	resname := mol.Atom(beads[0][0]).Molname
+	if resname == "" {
+		resname = "MOL"
+	}
+	fout, err := os.Create(outname)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	fout.WriteString(fmt.Sprintf("; Mapping written by Bartender - www.github.com/rmera/bartender\n\n[ molecule ]\n%s\n\n", resname))
+	if format == "vermouth" {
+		fout.WriteString("[ from ]\nuniversal\n\n[ to ]\nmartini3001\n\n")
+	}
+	fout.WriteString("[ martini ]\n" + strings.Join(names, " ") + "\n\n")
+	if format == "backward" {
+		fout.WriteString("[ mapping ]\nuniversal\n\n")
+	}
+	fout.WriteString("[ atoms ]\n")
+	atomnames := mappingAtomNames(mol)
+	for i := 0; i < mol.Len(); i++ {
+		var in []int
+		var w []float64
+		for j, b := range beads {
+			for k, a := range b {
+				if a == i {
+					in = append(in, j)
+					w = append(w, weights[j][k])
+				}
+			}
+		}
+		if len(in) == 0 && format == "vermouth" {
+			continue
+		}
+		if len(in) > 0 {
+			if total := floats.Sum(w); total != 0 && math.Abs(total-1) > 1e-6 {
+				LogV(0, fmt.Sprintf("The weights of atom %d in its beads add up to %.3f, not 1. They will be normalized in %s", i+1, total, outname))
+			}
+		}
+		str := fmt.Sprintf("%5d %5s ", i+1, atomnames[i])
+		for j, c := range repeats(w) {
+			if c == 0 && format == "vermouth" {
+				str += " !" + names[in[j]]
+			}
+			for k := 0; k < c; k++ {
+				str += " " + names[in[j]]
+			}
+		}
+		fout.WriteString(str + "\n")
+	}
+	return nil
+}
+
+//isMappingFile returns true if name is a backward (.map) or vermouth (.mapping) mapping file, judging by its extension.
+func isMappingFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".map" || ext == ".mapping"
+}
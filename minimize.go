@@ -0,0 +1,272 @@
+/*
+ * minimize.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"gonum.org/v1/gonum/optimize"
+)
+
+//Settings for the minimizations in the fits.
+type OptSettings struct {
+	seed       int64 //seed for the random generation of starting points. The same seed always gives the same results.
+	starts     int   //number of starting points. The first is always the initial guess.
+	iterations int   //maximum number of major iterations for each minimization
+}
+
+//DefaultOptSettings returns a reasonable set of settings for the minimizations.
+func DefaultOptSettings() *OptSettings {
+	return &OptSettings{seed: 1, starts: 6, iterations: 10000}
+}
+
+//ParBounds contains the allowed ranges for the parameters of a fit. Use math.Inf for
+//unbounded parameters. Parameters marked as integer can only take integer values.
+type ParBounds struct {
+	lower   []float64
+	upper   []float64
+	integer []bool
+}
+
+//NewParBounds returns bounds for n parameters, all of them unbounded and continuous.
+func NewParBounds(n int) *ParBounds {
+	B := &ParBounds{lower: make([]float64, n), upper: make([]float64, n), integer: make([]bool, n)}
+	for i := 0; i < n; i++ {
+		B.lower[i] = math.Inf(-1)
+		B.upper[i] = math.Inf(1)
+	}
+	return B
+}
+
+//bounder is implemented by potentials whose parameters are restricted to some range
+//(positive force constants, integer multiplicities, etc.)
+type bounder interface {
+	Bounds() *ParBounds
+}
+
+//Bounds returns the bounds for the parameters of p, in internal units.
+func Bounds(p Potential) *ParBounds {
+	if b, ok := p.(bounder); ok {
+		return b.Bounds()
+	}
+	return NewParBounds(len(p.ParNames()))
+}
+
+//The minimizations are carried out on unbounded variables, which are transformed into the bounded parameters
+//with the same transformations used by MINUIT. toBounded transforms the free variable u for the ith parameter.
+func (B *ParBounds) toBounded(i int, u float64) float64 {
+	lo, hi := B.lower[i], B.upper[i]
+	switch {
+	case !math.IsInf(lo, 0) && !math.IsInf(hi, 0):
+		return lo + (hi-lo)*(math.Sin(u)+1)/2
+	case !math.IsInf(lo, 0):
+		return lo - 1 + math.Sqrt(u*u+1)
+	case !math.IsInf(hi, 0):
+		return hi + 1 - math.Sqrt(u*u+1)
+	}
+	return u
+}
+
+//toFree is the inverse of toBounded. Values outside the bounds are first reflected on the bound they cross, and
+//brought slightly inside the allowed range, as the transformations have zero derivative at the bounds, so a
+//minimization starting there would never leave them.
+func (B *ParBounds) toFree(i int, x float64) float64 {
+	lo, hi := B.lower[i], B.upper[i]
+	if x < lo {
+		x = 2*lo - x
+	}
+	if x > hi {
+		x = 2*hi - x
+	}
+	if !math.IsInf(lo, 0) && !math.IsInf(hi, 0) {
+		margin := 1e-2 * (hi - lo)
+		x = math.Max(lo+margin, math.Min(hi-margin, x))
+	} else if !math.IsInf(lo, 0) {
+		x = math.Max(lo+1e-2*math.Max(1, math.Abs(lo)), x)
+	} else if !math.IsInf(hi, 0) {
+		x = math.Min(hi-1e-2*math.Max(1, math.Abs(hi)), x)
+	}
+	switch {
+	case !math.IsInf(lo, 0) && !math.IsInf(hi, 0):
+		return math.Asin(2*(x-lo)/(hi-lo) - 1)
+	case !math.IsInf(lo, 0):
+		return math.Sqrt(math.Pow(x-lo+1, 2) - 1)
+	case !math.IsInf(hi, 0):
+		return math.Sqrt(math.Pow(hi-x+1, 2) - 1)
+	}
+	return x
+}
+
+//integerCandidates returns the values to be tried for the integer parameter i, given the guess g.
+//If the allowed range is small, all the values in it are tried.
+func (B *ParBounds) integerCandidates(i int, g float64) []float64 {
+	lo, hi := B.lower[i], B.upper[i]
+	if hi-lo <= 10 {
+		ret := make([]float64, 0, 11)
+		for v := math.Ceil(lo); v <= hi; v++ {
+			ret = append(ret, v)
+		}
+		return ret
+	}
+	ret := make([]float64, 0, 3)
+	for _, v := range []float64{math.Round(g), math.Floor(g), math.Ceil(g)} {
+		if v >= lo && v <= hi && (len(ret) == 0 || ret[len(ret)-1] != v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+//Fit minimizes score, starting from guessp (nil elements are replaced by 1), with the parameters restricted
+//to the bounds in B, which can be nil. Several starting points, randomly perturbed from the guess, are tried,
+//and, for each, Newton, BFGS and Nelder-Mead minimizations, in that order, until one converges. Integer parameters
+//are fixed at each of their candidate values, while the rest are minimized. It returns the best parameters found
+//and the corresponding value of score, or an error if no minimization converged.
+func Fit(score func([]float64) float64, guessp []*float64, B *ParBounds, O *OptSettings) ([]float64, float64, error) {
+	if O == nil {
+		O = DefaultOptSettings()
+	}
+	guess := make([]float64, len(guessp))
+	for i, v := range guessp {
+		if v == nil {
+			guess[i] = 1 //as good a default guess as any, I suppose.
+		} else {
+			guess[i] = *v
+		}
+	}
+	if B == nil {
+		B = NewParBounds(len(guess))
+	}
+	//We build all the combinations of the values of the integer parameters.
+	combos := [][]float64{make([]float64, len(guess))}
+	for i, v := range B.integer {
+		if !v {
+			continue
+		}
+		var newcombos [][]float64
+		for _, c := range combos {
+			for _, w := range B.integerCandidates(i, guess[i]) {
+				nc := make([]float64, len(c))
+				copy(nc, c)
+				nc[i] = w
+				newcombos = append(newcombos, nc)
+			}
+		}
+		combos = newcombos
+	}
+	rng := rand.New(rand.NewSource(O.seed))
+	var best []float64
+	bestF := math.Inf(1)
+	for _, c := range combos {
+		x, f, err := fitContinuous(score, guess, c, B, O, rng)
+		if err != nil {
+			LogV(2, "Failed fit with integer parameters", c, err.Error())
+			continue
+		}
+		if f < bestF {
+			best, bestF = x, f
+		}
+	}
+	if best == nil {
+		return nil, math.NaN(), fmt.Errorf("no minimization converged from %d starting points", O.starts)
+	}
+	return best, bestF, nil
+}
+
+//fitContinuous minimizes score with respect to the non-integer parameters, while the integer ones are
+//fixed to the values in ints.
+func fitContinuous(score func([]float64) float64, guess, ints []float64, B *ParBounds, O *OptSettings, rng *rand.Rand) ([]float64, float64, error) {
+	free := make([]int, 0, len(guess)) //indexes of the parameters actually minimized
+	for i, v := range B.integer {
+		if !v {
+			free = append(free, i)
+		}
+	}
+	full := func(u []float64) []float64 {
+		x := make([]float64, len(guess))
+		copy(x, ints)
+		for j, i := range free {
+			x[i] = B.toBounded(i, u[j])
+		}
+		return x
+	}
+	fscore := func(u []float64) float64 {
+		return score(full(u))
+	}
+	if len(free) == 0 {
+		x := full(nil)
+		return x, score(x), nil
+	}
+	grad, hess := numDerivs(fscore)
+	prob := optimize.Problem{Func: fscore, Grad: grad, Hess: hess}
+	u0 := make([]float64, len(free))
+	for j, i := range free {
+		u0[j] = B.toFree(i, guess[i])
+	}
+	methods := []func() optimize.Method{
+		func() optimize.Method { return &optimize.Newton{} },
+		func() optimize.Method { return &optimize.BFGS{} },
+		func() optimize.Method { return &optimize.NelderMead{} },
+	}
+	var best []float64
+	bestF := math.Inf(1)
+	starts := O.starts
+	if starts < 1 {
+		starts = 1
+	}
+	for s := 0; s < starts; s++ {
+		start := make([]float64, len(u0))
+		copy(start, u0)
+		if s > 0 {
+			for j, v := range start {
+				start[j] = v + rng.NormFloat64()*math.Max(0.5*math.Abs(v), 0.5)
+			}
+		}
+		for m, method := range methods {
+			conv := optimize.FunctionConverge{Absolute: 1e-10, Relative: 1e-10, Iterations: 100}
+			settings := &optimize.Settings{MajorIterations: O.iterations, Converger: &conv}
+			ret, err := optimize.Minimize(prob, start, settings, method())
+			if err == nil && ret.Status != optimize.IterationLimit && !math.IsNaN(ret.F) && !math.IsInf(ret.F, 0) {
+				LogV(3, "Start", s, "converged with method", m, ret.F, "Iterations", ret.MajorIterations)
+				if ret.F < bestF {
+					best, bestF = ret.X, ret.F
+				}
+				break
+			}
+			LogV(3, "Start", s, "failed with method", m, "will try the next one")
+			if ret != nil && !math.IsNaN(ret.F) {
+				start = ret.X //the next method starts where this one stopped.
+			}
+		}
+	}
+	if best == nil {
+		return nil, math.NaN(), fmt.Errorf("no minimization converged")
+	}
+	return full(best), bestF, nil
+}
@@ -0,0 +1,203 @@
+/*
+ * mock.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+)
+
+//Parameters for the mock engine. Distances in A, force constants in kJ/mol/A^2, times in ps.
+const (
+	mockCutoff   = 6.0    //atoms closer than this in the starting geometry are joined by a spring
+	mockBondDist = 1.9    //pairs closer than this are considered bonded
+	mockKBond    = 2500.0 //force constant for the springs between bonded atoms
+	mockKOther   = 20.0   //force constant for the other springs
+	mockStep     = 0.0005 //time step
+	mockFriction = 5.0    //Langevin friction coefficient, 1/ps
+)
+
+//mockEngine runs Langevin dynamics on an elastic network model, in pure Go, so it needs no external program.
+//Every pair of atoms closer than mockCutoff in the starting geometry is joined by a harmonic spring, with
+//the distance in that geometry as equilibrium length, and a larger force constant for the pairs that seem bonded.
+//It is meant for testing, not for production: the distributions obtained have nothing to do with those of the real molecule.
+//The same seed (MD.seed) always produces the same trajectory.
+type mockEngine struct{}
+
+func (m mockEngine) Name() string {
+	return "mock"
+}
+
+func (m mockEngine) TrajName(S *MDSettings) string {
+	return filepath.Join(S.dir, "mock.trj")
+}
+
+//a harmonic spring between the atoms i and j
+type mockSpring struct {
+	i, j int
+	k    float64
+	eq   float64
+}
+
+//Run runs the MD in the directory MD.dir, or in the current one, if MD.dir is not given, and writes the trajectory to mock.trj,
+//with the frames separated by MD.dump. The other integration settings in MD are not used.
+//As xtb, it writes the potential energy of each frame, in Hartree, in its comment line. If MD.time is not larger than 0,
+//no MD is run, and the trajectory from a previous run in the same directory is used.
+func (m mockEngine) Run(coord *v3.Matrix, mol chem.AtomMultiCharger, MD *MDSettings) (*MDOutput, error) {
+	if MD.temp == 0 {
+		MD.temp = 298.0
+	}
+	trj := m.TrajName(MD)
+	if MD.time <= 0 {
+		MD.time = 500
+		if _, err := os.Stat(trj); err != nil {
+			return nil, err
+		}
+		return &MDOutput{engine: m.Name(), trajname: trj, temp: MD.temp, time: MD.time}, nil
+	}
+	N := coord.NVecs()
+	x := make([][3]float64, N)
+	for i := range x {
+		for c := 0; c < 3; c++ {
+			x[i][c] = coord.At(i, c)
+		}
+	}
+	springs := make([]mockSpring, 0, N*4)
+	for i := 0; i < N; i++ {
+		for j := i + 1; j < N; j++ {
+			d := mockDist(x[i], x[j])
+			if d > mockCutoff {
+				continue
+			}
+			k := mockKOther
+			if d < mockBondDist {
+				k = mockKBond
+			}
+			springs = append(springs, mockSpring{i: i, j: j, k: k, eq: d})
+		}
+	}
+	//the acceleration is 100*F/m, in A/ps^2, with F in kJ/mol/A and m in amu.
+	invm := make([]float64, N)
+	for i := range invm {
+		mass := mol.Atom(i).Mass
+		if mass <= 0 {
+			mass = 12.0
+		}
+		invm[i] = 100 / mass
+	}
+	kT := chem.R * MD.temp
+	rng := rand.New(rand.NewSource(MD.seed))
+	v := make([][3]float64, N)
+	for i := range v {
+		for c := 0; c < 3; c++ {
+			v[i][c] = rng.NormFloat64() * math.Sqrt(kT*invm[i])
+		}
+	}
+	f := make([][3]float64, N)
+	U := mockForces(x, springs, f)
+	fout, err := os.Create(trj)
+	if err != nil {
+		return nil, err
+	}
+	defer fout.Close()
+	w := bufio.NewWriter(fout)
+	dt := mockStep
+	c1 := math.Exp(-mockFriction * dt)
+	c2 := math.Sqrt(1 - c1*c1)
+	steps := int(float64(MD.time)/dt + 0.5)
+	MD.SetDefaults()
+	dump := int(MD.dump/1000/dt + 0.5) //MD.dump is in fs
+	if dump < 1 {
+		dump = 1
+	}
+	//BAOAB integrator (Leimkuhler and Matthews)
+	for s := 1; s <= steps; s++ {
+		for i := range x {
+			for c := 0; c < 3; c++ {
+				v[i][c] += 0.5 * dt * f[i][c] * invm[i]
+				x[i][c] += 0.5 * dt * v[i][c]
+				v[i][c] = c1*v[i][c] + c2*math.Sqrt(kT*invm[i])*rng.NormFloat64()
+				x[i][c] += 0.5 * dt * v[i][c]
+			}
+		}
+		U = mockForces(x, springs, f)
+		for i := range v {
+			for c := 0; c < 3; c++ {
+				v[i][c] += 0.5 * dt * f[i][c] * invm[i]
+			}
+		}
+		if s%dump != 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%d\n energy: %.12f gnorm: 0.0 mock\n", N, U/(chem.H2Kcal*chem.Kcal2KJ))
+		for i, p := range x {
+			fmt.Fprintf(w, "%-2s %15.8f %15.8f %15.8f\n", mol.Atom(i).Symbol, p[0], p[1], p[2])
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return &MDOutput{engine: m.Name(), trajname: trj, temp: MD.temp, time: MD.time}, nil
+}
+
+//mockForces puts the forces on each atom, for the positions x, in f, and returns the potential energy.
+func mockForces(x [][3]float64, springs []mockSpring, f [][3]float64) float64 {
+	for i := range f {
+		f[i] = [3]float64{}
+	}
+	U := 0.0
+	for _, s := range springs {
+		d := mockDist(x[s.i], x[s.j])
+		delta := d - s.eq
+		U += 0.5 * s.k * delta * delta
+		if d == 0 {
+			continue
+		}
+		g := -s.k * delta / d
+		for c := 0; c < 3; c++ {
+			fc := g * (x[s.i][c] - x[s.j][c])
+			f[s.i][c] += fc
+			f[s.j][c] -= fc
+		}
+	}
+	return U
+}
+
+func mockDist(a, b [3]float64) float64 {
+	var d2 float64
+	for c := 0; c < 3; c++ {
+		d2 += (a[c] - b[c]) * (a[c] - b[c])
+	}
+	return math.Sqrt(d2)
+}
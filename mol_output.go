@@ -62,7 +62,7 @@ func MakePDB(coord *v3.Matrix, mol chem.Atomer, indexes [][]int) {
 //Saves the multi-xyz trajectory in the file trajname to a DCD trajectory in the file fname.
 //Since this is not really  needed, it doesn't panic. Will just return an error to be printed by main.
 func DCDSave(fname, trajname string) error {
-	if !strings.Contains(trajname, ".trj") {
+	if !strings.HasSuffix(trajname, ".trj") && !strings.HasSuffix(trajname, ".xyz") {
 		return fmt.Errorf("Option only available for multi-xyz trajectories, such as those produced by xtb")
 	}
 	mol, err := chem.XYZFileRead(trajname)
@@ -0,0 +1,269 @@
+/*
+ * multimd.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/stat"
+)
+
+//The standard deviation, in A, of the random displacements applied to the starting coordinates of all but the first
+//of the runs with the same starting geometry, so their trajectories diverge even if the engine is deterministic.
+const seedDisplacement = 0.05
+
+//Seeds whose distribution for a degree of freedom differs from the one for all seeds by a Jensen-Shannon divergence
+//(in nats) larger than this, are reported as disagreeing.
+const seedJSDThreshold = 0.05
+
+//IndependentMD runs, with the engine, seeds independent MDs from each of the starting geometries in starts, each in its own
+//sub-directory of S.dir, with its own seed. The runs are performed at the same time, sharing the S.cpus CPUs, and the total
+//simulation time, S.time. Their trajectories are merged. If there is only one run, it is performed in S.dir, and nothing is merged.
+//If resume is true, the runs are resumed (see RunMD). Replica-exchange engines run only once, from the first geometry.
+func IndependentMD(engine MDEngine, starts []*v3.Matrix, mol chem.AtomMultiCharger, S *MDSettings, seeds int, resume bool) (*MDOutput, error) {
+	if seeds < 1 {
+		seeds = 1
+	}
+	if _, ok := engine.(*remdEngine); ok && len(starts)*seeds > 1 {
+		LogV(0, "Only one replica-exchange MD is performed, from the first starting geometry")
+		starts, seeds = starts[:1], 1
+	}
+	if len(starts)*seeds == 1 {
+		return RunMD(engine, starts[0], mol, S, resume)
+	}
+	if S.cpus < 0 {
+		S.cpus = runtime.NumCPU()
+	}
+	runs := make([]*MDSettings, 0, len(starts)*seeds)
+	coords := make([]*v3.Matrix, 0, cap(runs))
+	cpusper := S.cpus / cap(runs)
+	if cpusper < 1 {
+		cpusper = 1
+	}
+	for i, c := range starts {
+		for k := 0; k < seeds; k++ {
+			R := *S
+			R.dir = filepath.Join(S.dir, fmt.Sprintf("md%02d", len(runs)))
+			R.time = S.time / cap(runs)
+			if R.time < 1 {
+				R.time = 1
+			}
+			R.seed = S.seed + int64(len(runs))
+			R.cpus = cpusper
+			if err := os.MkdirAll(R.dir, 0755); err != nil {
+				return nil, err
+			}
+			//Every run but the first is displaced, as xtb ignores the seed.
+			coord := c
+			if len(runs) > 0 {
+				coord = displaced(c, R.seed)
+			}
+			LogV(2, fmt.Sprintf("Independent MD %d: starting geometry %d, seed %d, %d ps, %d CPUs", len(runs), i, R.seed, R.time, R.cpus))
+			runs = append(runs, &R)
+			coords = append(coords, coord)
+		}
+	}
+	parallel := S.cpus / cpusper
+	if parallel < 1 {
+		parallel = 1
+	}
+	LogV(1, fmt.Sprintf("Running %d independent MDs, %d at a time", len(runs), parallel))
+	outs := make([]*MDOutput, len(runs))
+	errs := make([]error, len(runs))
+	sem := make(chan bool, parallel)
+	var wg sync.WaitGroup
+	for i, R := range runs {
+		wg.Add(1)
+		sem <- true
+		go func(i int, R *MDSettings) {
+			defer wg.Done()
+			outs[i], errs[i] = RunMD(engine, coords[i], mol, R, resume)
+			<-sem
+		}(i, R)
+	}
+	wg.Wait()
+	merged := filepath.Join(S.dir, "merged.trj")
+	os.Remove(merged)
+	parts := make([]string, len(runs))
+	for i, o := range outs {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("Independent MD in %s: %s", runs[i].dir, errs[i].Error())
+		}
+		if err := appendFile(merged, o.trajname); err != nil {
+			return nil, err
+		}
+		parts[i] = o.trajname
+	}
+	return &MDOutput{engine: engine.Name(), trajname: merged, parts: parts, temp: S.temp, time: S.time}, nil
+}
+
+//displaced returns a copy of coord with each coordinate displaced by a random amount, with a standard
+//deviation of seedDisplacement, obtained with the given seed.
+func displaced(coord *v3.Matrix, seed int64) *v3.Matrix {
+	rng := rand.New(rand.NewSource(seed))
+	ret := v3.Zeros(coord.NVecs())
+	ret.Copy(coord)
+	for i := 0; i < ret.NVecs(); i++ {
+		for j := 0; j < 3; j++ {
+			ret.Set(i, j, ret.At(i, j)+rng.NormFloat64()*seedDisplacement)
+		}
+	}
+	return ret
+}
+
+//PartFrames returns the number of frames in each of the trajectories in parts, which must have the
+//energy of each frame in their comment lines, as xtb writes them.
+func PartFrames(parts []string) ([]int, error) {
+	ret := make([]int, len(parts))
+	for i, v := range parts {
+		E, err := XYZEnergies(v)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = len(E)
+	}
+	return ret, nil
+}
+
+//SeedReport compares the distributions of every degree of freedom in datamap obtained from each of the independent runs
+//merged in it, which contributed, in order, the number of frames in frames. For each degree of freedom and run, the mean,
+//the standard deviation and the Jensen-Shannon divergence from the distribution of all runs together are written to the file
+//outname, and the distributions (histograms with corrBins bins) to the file distname. Degrees of freedom for which the runs
+//disagree are reported.
+func SeedReport(datamap map[string][][]float64, wanted map[string][][]int, frames []int, outname, distname string) {
+	fout, err := os.Create(outname)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer fout.Close()
+	fdist, err := os.Create(distname)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer fdist.Close()
+	fout.WriteString("# Agreement between independent MD runs by Bartender - www.github.com/rmera/bartender\n")
+	fout.WriteString("# dof\trun\tframes\tmean\tstddev\tJSD(nats)\n")
+	fdist.WriteString("# dof\trun\tvalue\tprobability\n")
+	for _, d := range dofList(datamap, wanted) {
+		if len(d.data) != int(floats.Sum(intsToFloats(frames))) {
+			panic(fmt.Sprintf("SeedReport: %d frames for %s, but the runs have %d", len(d.data), d.Name(), int(floats.Sum(intsToFloats(frames)))))
+		}
+		conv := 1.0
+		if d.kind != "bonds" {
+			conv = chem.Rad2Deg
+		}
+		//Rather coarse bins, as the runs can be short, and the divergence is overestimated when the bins have few samples.
+		width := corrWidth(d.data)
+		lower := floats.Min(d.data)
+		nbins := int((floats.Max(d.data)-lower)/width) + 1
+		pooled := histogram(d.data, lower, width, nbins)
+		worst := 0.0
+		first := 0
+		for r, n := range frames {
+			part := d.data[first : first+n]
+			first += n
+			var mean, sd float64
+			if d.circular() {
+				mean, sd = circMean(part, nil), circStdDev(part)
+			} else {
+				mean, sd = stat.MeanStdDev(part, nil)
+			}
+			h := histogram(part, lower, width, nbins)
+			jsd := jensenShannon(h, pooled)
+			worst = math.Max(worst, jsd)
+			fout.WriteString(fmt.Sprintf("%s\t%d\t%d\t%.4f\t%.4f\t%.4f\n", d.Name(), r, n, mean*conv, sd*conv, jsd))
+			for b, p := range h {
+				if p > 0 {
+					fdist.WriteString(fmt.Sprintf("%s\t%d\t%.4f\t%.5f\n", d.Name(), r, (lower+(float64(b)+0.5)*width)*conv, p))
+				}
+			}
+		}
+		if worst > seedJSDThreshold {
+			LogV(0, fmt.Sprintf("The independent MD runs disagree on the distribution for the %s between beads %s (Jensen-Shannon divergence up to %.3f nats). The sampling may be insufficient", CategoryName(d.kind), BeadsText(d.beads), worst))
+		}
+	}
+}
+
+func intsToFloats(a []int) []float64 {
+	ret := make([]float64, len(a))
+	for i, v := range a {
+		ret[i] = float64(v)
+	}
+	return ret
+}
+
+//histogram returns the normalized histogram for data, with nbins bins of the given width, the first one starting at lower.
+func histogram(data []float64, lower, width float64, nbins int) []float64 {
+	ret := make([]float64, nbins)
+	for _, v := range data {
+		b := int((v - lower) / width)
+		if b >= nbins {
+			b = nbins - 1
+		}
+		ret[b]++
+	}
+	floats.Scale(1/float64(len(data)), ret)
+	return ret
+}
+
+//jensenShannon returns the Jensen-Shannon divergence, in nats, between the normalized histograms p and q.
+func jensenShannon(p, q []float64) float64 {
+	kl := func(a, m []float64) float64 {
+		ret := 0.0
+		for i, v := range a {
+			if v > 0 {
+				ret += v * math.Log(v/m[i])
+			}
+		}
+		return ret
+	}
+	m := make([]float64, len(p))
+	for i := range p {
+		m[i] = (p[i] + q[i]) / 2
+	}
+	return (kl(p, m) + kl(q, m)) / 2
+}
+
+//circStdDev returns the circular standard deviation of the angles in data.
+func circStdDev(data []float64) float64 {
+	var s, c float64
+	for _, v := range data {
+		s += math.Sin(v)
+		c += math.Cos(v)
+	}
+	R := math.Hypot(s, c) / float64(len(data))
+	return math.Sqrt(-2 * math.Log(R))
+}
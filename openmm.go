@@ -0,0 +1,277 @@
+/*
+ * openmm.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	chem "github.com/rmera/gochem"
+)
+
+//The energy expressions for the potentials that OpenMM lacks, in OpenMM units (nm, kJ/mol, radians).
+//The first two are for the CustomAngleForce, the rest, for the CustomTorsionForce. The improper uses the usual
+//OpenMM idiom to keep the difference between the angles within pi.
+var openmmExpressions = map[string]string{
+	"angles2": "0.5*k*(cos(theta)-cos(theta0))^2",
+	"reb10":   "0.5*k*(cos(theta)-cos(theta0))^2/sin(theta)^2",
+	"dihe10":  "0.5*k*(cos(theta)-cos(theta0))^2/sin(theta)^2",
+	"improp2": "0.5*k*dt^2; dt=min(d, 2*pi-d); d=abs(theta-theta0); pi=3.14159265358979",
+}
+
+//The combined bending-torsion potential depends on the bending angles, so it needs a CustomCompoundBondForce.
+const openmmBendingTorsion = "sin(angle(p1,p2,p3))^3*sin(angle(p2,p3,p4))^3*(a0+a1*c+a2*c^2+a3*c^3+a4*c^4); c=cos(dihedral(p1,p2,p3,p4))"
+
+//openmmKey returns the key for the potential of b in openmmExpressions.
+func openmmKey(b *bonded) string {
+	return fmt.Sprintf("%s%d", b.pot.Kind(), b.pot.FuncType())
+}
+
+//openmmTypes returns the attributes with the atom types for the given beads.
+func openmmTypes(beads []int, types []string) string {
+	ret := ""
+	for i, v := range beads {
+		ret += fmt.Sprintf(" type%d=\"%s\"", i+1, types[v])
+	}
+	return ret
+}
+
+//openmmChained returns true if every pair of consecutive beads in b is bonded, according to bonds.
+//OpenMM only applies angles and torsions to beads connected that way.
+func openmmChained(b *bonded, bonds map[[2]int]bool) bool {
+	for i := 1; i < len(b.beads); i++ {
+		if !bonds[pairKey(b.beads[i-1], b.beads[i])] {
+			return false
+		}
+	}
+	return true
+}
+
+//openmmImproper returns the beads of the improper b in the order of an OpenMM <Improper> entry, or nil if OpenMM can't apply it.
+//OpenMM applies impropers only to a central bead bonded to the other three, which goes first, and takes the torsion between the
+//second, third, first and fourth beads, with the second and third sorted by index (as the beads have no elements). The GROMACS improper
+//is the torsion between its beads in order, so its central bead must be the third one or, taking the torsion backwards, the second.
+func openmmImproper(b *bonded, bonds map[[2]int]bool) []int {
+	central := func(c int) bool {
+		for _, v := range b.beads {
+			if v != c && !bonds[pairKey(v, c)] {
+				return false
+			}
+		}
+		return true
+	}
+	p := b.beads
+	if central(p[2]) && p[0] < p[1] {
+		return []int{p[2], p[0], p[1], p[3]}
+	}
+	if central(p[1]) && p[3] < p[2] {
+		return []int{p[1], p[3], p[2], p[0]}
+	}
+	return nil
+}
+
+//PrintOpenMM writes the interactions in params used in the GROMACS topology to the OpenMM ForceField XML file outname. There is one
+//residue template, with one atom, and atom type, per bead, with the mass of its atoms, and the bonds fitted. Harmonic bonds and angles, simple
+//periodic and Ryckaert-Bellemans dihedrals are written as the equivalent OpenMM forces. The other potentials are written as custom forces,
+//with their energy expressions. As constraints can't be given per bond in the XML format, the bonds that are constraints in the itp are
+//added to the System by a script in the XML. The constraints are also bonds of the template, so the impropers on the hinges of rigid rings
+//can be applied. Only the bonded interactions are written.
+//The lines in header, if any, are written as comments. Since this is not really needed, it doesn't panic.
+func PrintOpenMM(params map[string][]*bonded, mol chem.Atomer, beads [][]int, weights [][]float64, outname string, header []string) error {
+	resname := mol.Atom(beads[0][0]).Molname
+	if resname == "" {
+		resname = "MOL"
+	}
+	names := make([]string, len(beads))
+	types := make([]string, len(beads))
+	for i := range beads {
+		names[i] = fmt.Sprintf("B%d", i+1)
+		types[i] = resname + "-" + names[i]
+	}
+	bonds := UsedBonded(params, "bonds")
+	bondset := make(map[[2]int]bool)
+	for _, v := range bonds {
+		bondset[pairKey(v.beads[0], v.beads[1])] = true
+	}
+	//Everything else, grouped by the OpenMM force used.
+	angles := make([]*bonded, 0, 10)
+	propers := make([]*bonded, 0, 10)
+	rbs := make([]*bonded, 0, 10)
+	bts := make([]*bonded, 0, 2)
+	custom := make(map[string][]*bonded)
+	customOrder := make([]string, 0, 4)
+	improper := make(map[*bonded][]int) //the beads of each improper, in the OpenMM order
+	for _, k := range []string{"angles", "reb", "dihe", "improp"} {
+		for _, v := range UsedBonded(params, k) {
+			if k == "improp" {
+				if improper[v] = openmmImproper(v, bondset); improper[v] == nil {
+					LogV(0, fmt.Sprintf("Improper for beads%s not exported to OpenMM: neither its second nor its third bead is bonded to the other three", BeadsText(v.beads)))
+					continue
+				}
+			} else if !openmmChained(v, bondset) {
+				LogV(0, fmt.Sprintf("Beads%s are not all connected by bonds, so OpenMM will not apply the %s potential to them", BeadsText(v.beads), v.pot.Name()))
+			}
+			key := openmmKey(v)
+			switch key {
+			case "angles1":
+				angles = append(angles, v)
+			case "dihe1":
+				propers = append(propers, v)
+			case "dihe3":
+				rbs = append(rbs, v)
+			case "dihe11":
+				bts = append(bts, v)
+			default:
+				if _, ok := openmmExpressions[key]; !ok {
+					LogV(0, fmt.Sprintf("%s for beads %s not exported to OpenMM: no equivalent for the %s potential", CategoryName(k), BeadsText(v.beads), v.pot.Name()))
+					continue
+				}
+				if _, ok := custom[key]; !ok {
+					customOrder = append(customOrder, key)
+				}
+				custom[key] = append(custom[key], v)
+			}
+		}
+	}
+
+	fout, err := os.Create(outname)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	fout.WriteString("<ForceField>\n")
+	fout.WriteString(" <!-- Force field by Bartender - www.github.com/rmera/bartender -->\n")
+	fout.WriteString(" <!-- Please cite the Bartender reference: XXXXXXXXXXX -->\n")
+	for _, v := range header {
+		fout.WriteString(" <!-- " + strings.ReplaceAll(v, "--", "- -") + " -->\n")
+	}
+	fout.WriteString(" <!-- Only bonded interactions. Units: nm, kJ/mol, radians -->\n")
+	fout.WriteString(" <AtomTypes>\n")
+	for i, v := range beads {
+		mass := 0.0
+		for j, w := range v {
+			mass += mol.Atom(w).Mass * weights[i][j]
+		}
+		fout.WriteString(fmt.Sprintf("  <Type name=\"%s\" class=\"%s\" mass=\"%.3f\"/>\n", types[i], types[i], mass))
+	}
+	fout.WriteString(" </AtomTypes>\n <Residues>\n")
+	fout.WriteString(fmt.Sprintf("  <Residue name=\"%s\">\n", resname))
+	for i, v := range names {
+		fout.WriteString(fmt.Sprintf("   <Atom name=\"%s\" type=\"%s\"/>\n", v, types[i]))
+	}
+	for _, v := range bonds {
+		fout.WriteString(fmt.Sprintf("   <Bond atomName1=\"%s\" atomName2=\"%s\"/>\n", names[v.beads[0]], names[v.beads[1]]))
+	}
+	fout.WriteString("  </Residue>\n </Residues>\n")
+
+	//Bonds and constraints
+	fout.WriteString(" <HarmonicBondForce>\n")
+	constraints := ""
+	for _, v := range bonds {
+		if Constrained(v) {
+			constraints += fmt.Sprintf("  (%q, %q, %.5f),\n", names[v.beads[0]], names[v.beads[1]], v.params[0])
+			continue
+		}
+		fout.WriteString(fmt.Sprintf("  <Bond%s length=\"%.5f\" k=\"%.2f\"/>\n", openmmTypes(v.beads, types), v.params[0], v.params[1]))
+	}
+	fout.WriteString(" </HarmonicBondForce>\n")
+	if constraints != "" {
+		fout.WriteString(" <Script>\n")
+		fout.WriteString("# The bonds that are constraints in the GROMACS topology.\n")
+		fout.WriteString(fmt.Sprintf("for res in topology.residues():\n    if res.name != %q:\n        continue\n", resname))
+		fout.WriteString("    index = {a.name: a.index for a in res.atoms()}\n")
+		fout.WriteString("    for a1, a2, length in [\n" + constraints + "    ]:\n")
+		fout.WriteString("        sys.addConstraint(index[a1], index[a2], length)\n")
+		fout.WriteString(" </Script>\n")
+	}
+
+	if len(angles) > 0 {
+		fout.WriteString(" <HarmonicAngleForce>\n")
+		for _, v := range angles {
+			p := InternalPar(v.pot, v.params)
+			fout.WriteString(fmt.Sprintf("  <Angle%s angle=\"%.5f\" k=\"%.3f\"/>\n", openmmTypes(v.beads, types), p[0], p[1]))
+		}
+		fout.WriteString(" </HarmonicAngleForce>\n")
+	}
+	if len(propers) > 0 {
+		fout.WriteString(" <PeriodicTorsionForce>\n")
+		for _, v := range propers {
+			p := InternalPar(v.pot, v.params)
+			fout.WriteString(fmt.Sprintf("  <Proper%s periodicity1=\"%d\" phase1=\"%.5f\" k1=\"%.3f\"/>\n", openmmTypes(v.beads, types), int(math.Round(p[2])), p[0], p[1]))
+		}
+		fout.WriteString(" </PeriodicTorsionForce>\n")
+	}
+	if len(rbs) > 0 {
+		fout.WriteString(" <RBTorsionForce>\n")
+		for _, v := range rbs {
+			c := ""
+			for i, w := range v.params {
+				c += fmt.Sprintf(" c%d=\"%.4f\"", i, w)
+			}
+			fout.WriteString(fmt.Sprintf("  <Proper%s%s/>\n", openmmTypes(v.beads, types), c))
+		}
+		fout.WriteString(" </RBTorsionForce>\n")
+	}
+	for _, key := range customOrder {
+		force, param, entry := "CustomTorsionForce", "PerTorsionParameter", "Proper"
+		if key == "angles2" || key == "reb10" {
+			force, param, entry = "CustomAngleForce", "PerAngleParameter", "Angle"
+		}
+		fout.WriteString(fmt.Sprintf(" <%s energy=\"%s\">\n", force, openmmExpressions[key]))
+		fout.WriteString(fmt.Sprintf("  <%s name=\"theta0\"/>\n  <%s name=\"k\"/>\n", param, param))
+		if strings.HasPrefix(key, "improp") {
+			entry = "Improper"
+		}
+		for _, v := range custom[key] {
+			p := InternalPar(v.pot, v.params)
+			beads := v.beads
+			if entry == "Improper" {
+				beads = improper[v]
+			}
+			fout.WriteString(fmt.Sprintf("  <%s%s theta0=\"%.5f\" k=\"%.3f\"/> <!-- %s -->\n", entry, openmmTypes(beads, types), p[0], p[1], v.pot.Name()))
+		}
+		fout.WriteString(fmt.Sprintf(" </%s>\n", force))
+	}
+	if len(bts) > 0 {
+		fout.WriteString(fmt.Sprintf(" <CustomCompoundBondForce particlesPerBond=\"4\" energy=\"%s\">\n", openmmBendingTorsion))
+		for i := range bts[0].params {
+			fout.WriteString(fmt.Sprintf("  <PerBondParameter name=\"a%d\"/>\n", i))
+		}
+		for _, v := range bts {
+			a := ""
+			for i, w := range v.params {
+				a += fmt.Sprintf(" a%d=\"%.4f\"", i, w)
+			}
+			fout.WriteString(fmt.Sprintf("  <Bond%s%s/>\n", openmmTypes(v.beads, types), a))
+		}
+		fout.WriteString(" </CustomCompoundBondForce>\n")
+	}
+	fout.WriteString("</ForceField>\n")
+	return nil
+}
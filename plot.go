@@ -1,8 +1,8 @@
 package main
 
 import (
+	"fmt"
 	"image/color"
-	"math"
 	"strings"
 
 	chem "github.com/rmera/gochem"
@@ -12,63 +12,69 @@ import (
 	"gonum.org/v1/plot/vg/draw"
 )
 
-//This is mostly repeated code from fit_go. I might refactor things so these functions are called there to eliminate that problem.
-
-func sperf(par []float64) func(float64) float64 {
-	eq := par[0]
-	k := par[1]
-	n := par[2]
-	return func(x float64) float64 { return k * (1 + math.Cos(n*x-eq)) }
-}
-
-func hookef(par []float64) func(float64) float64 {
-	eq := par[0]
-	k := par[1]
-	return func(x float64) float64 { return 0.5 * k * math.Pow((x-eq), 2.0) }
-}
-
-func rebf(par []float64) func(float64) float64 {
-	eq := par[0]
-	k := par[1]
-
-	return func(x float64) float64 {
-		//Here I also changed "eq" for "math.Cos(eq)". This seems to agree with the Gromacs
-		//Manual so I think the previous behavior was a bug (see also the comment in the ReB part of the fit_go.go file)
-		return 0.5 * k * math.Pow((math.Cos(x)-math.Cos(eq)), 2.0) * (1 / math.Pow(math.Sin(x), 2))
+//PlotPotential plots the energies y vs x, and the potential p, with the parameters par, in internal units, as a line.
+//The plot is named after the potential and the beads involved, given in beadst.
+func PlotPotential(p Potential, par, x, y []float64, beadst string, noplot bool) error {
+	unit_conv := chem.Rad2Deg
+	if p.Kind() == "bonds" {
+		unit_conv = 1.0
 	}
+	E := p.Energy(par)
+	f := func(x float64) float64 { return E(x) }
+	return Plot(f, x, y, fmt.Sprintf("%s_%s", p.Name(), beadst), unit_conv, noplot)
 }
 
-func rybef(p []float64) func(float64) float64 {
-	ret := func(x float64) float64 {
-		psi := x - math.Pi
-		cos := math.Cos
-		pow := math.Pow
-		return p[0] + p[1]*cos(psi) + p[2]*pow(cos(psi), 2) + p[3]*pow(cos(psi), 3) + p[4]*pow(cos(psi), 4) + p[5]*pow(cos(psi), 5)
+//PlotProjection plots, for a potential p that depends on several degrees of freedom, the energies y and the
+//energies given by p with the parameters par, both vs the first degree of freedom, as points.
+//x contains one slice per degree of freedom, each with one element per point, in internal units.
+func PlotProjection(p Potential, par []float64, x [][]float64, y []float64, beadst string, noplot bool) error {
+	if noplot {
+		return nil
 	}
-	return ret
-}
-
-func cosanglef(par []float64) func(float64) float64 {
-	eq := par[0]
-	k := par[1]
-
-	return func(x float64) float64 {
-		return 0.5 * k * math.Pow((math.Cos(x)-math.Cos(eq)), 2.0)
+	E := p.Energy(par)
+	fitted := make([]float64, len(y))
+	pt := make([]float64, len(x))
+	for i := range y {
+		for j, w := range x {
+			pt[j] = w[i]
+		}
+		fitted[i] = E(pt...)
 	}
+	name := strings.ReplaceAll(fmt.Sprintf("%s_%s", p.Name(), beadst), " ", "")
+	pl, err := plot.New()
+	if err != nil {
+		return err
+	}
+	pl.Title.Text = name
+	pl.X.Label.Text = "X"
+	pl.Y.Label.Text = "Y"
+	pl.Add(plotter.NewGrid())
+	s, err := plotter.NewScatter(pointsPlot(x[0], y, chem.Rad2Deg))
+	if err != nil {
+		return err
+	}
+	s.GlyphStyle.Shape = draw.PyramidGlyph{}
+	s.GlyphStyle.Color = color.RGBA{R: 255, A: 255}
+	f, err := plotter.NewScatter(pointsPlot(x[0], fitted, chem.Rad2Deg))
+	if err != nil {
+		return err
+	}
+	f.GlyphStyle.Shape = draw.CircleGlyph{}
+	f.GlyphStyle.Color = color.RGBA{B: 255, A: 255}
+	pl.Add(s, f)
+	pl.Legend.Add("Trajectory", s)
+	pl.Legend.Add("Fitted function", f)
+	return pl.Save(6*vg.Inch, 6*vg.Inch, name+".png")
 }
 
 //plots y and f(x) vs x, as points and a line, respectively, unless given true in noplot, in which case, does nothing.
+//x is multiplied by unit_conv for the plot (so angles in radians can be plotted in degrees).
 //the plot is saved to a file name.png
-func Plot(f func(float64) float64, x, y []float64, name string, noplot bool) error {
+func Plot(f func(float64) float64, x, y []float64, name string, unit_conv float64, noplot bool) error {
 	if noplot {
 		return nil
 	}
 	name = strings.ReplaceAll(name, " ", "")
-	unit_conv := 1.0
-	has := strings.Contains
-	if has(name, "ngle") || has(name, "Rycka") || has(name, "Cos") || has(name, "eriodic") || has(name, "mproper") {
-		unit_conv = chem.Rad2Deg
-	}
 	pointsData := pointsPlot(x, y, unit_conv)
 	funcData := funcPlot(x, f, unit_conv)
 	p, err := plot.New()
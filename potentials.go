@@ -0,0 +1,473 @@
+/*
+ * potentials.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+
+	chem "github.com/rmera/gochem"
+)
+
+//Potential is a functional form that can be fitted to the energies obtained by Boltzmann-inversion
+//of the distribution of a bonded degree of freedom. Parameters are handled in internal units
+//(nm, radians, kJ/mol) everywhere except in the bonded structures, where they are kept in
+//GROMACS units (i.e. angles in degrees). The conversion is done from the units
+//declared by ParUnits, see GromacsPar and InternalPar.
+//To add a new functional form, implement this interface and register it in the init function
+//at the end of this file. Fitting, plotting and printing will then pick it up.
+type Potential interface {
+	//A short name, used in the logs and in the names of the plots.
+	Name() string
+	//The kind of interaction this potential is used for. It is the key in the datamap
+	//("bonds", "angles", "reb", "dihe" or "improp").
+	Kind() string
+	//The GROMACS function type.
+	FuncType() int
+	//The names of the parameters, in the order they are fitted and printed.
+	ParNames() []string
+	//The units of the parameters, as printed in the itp.
+	ParUnits() []string
+	//The energy, in kJ/mol, as a function of the degree(s) of freedom, for the parameters par.
+	Energy(par []float64) func(x ...float64) float64
+	//Puts in g the derivatives of the energy with respect to each parameter, at the point x.
+	Deriv(g, par []float64, x ...float64)
+	//An initial guess for the parameters, from the Boltzmann-inverted energies y at the points x.
+	Guess(x, y []float64) []*float64
+	//The line for this interaction in a GROMACS itp file, including the newline.
+	ITP(b *bonded) string
+}
+
+//Fitter is implemented by potentials that need a special fitting procedure
+//(retries, corrections to the fitted values, etc.). Potentials that don't implement
+//it are fitted by the generic procedure in FitPotential.
+type Fitter interface {
+	Fit(x, y []float64, O *OptSettings) ([]float64, float64, error)
+}
+
+//multiDim is implemented by potentials that depend on more than one
+//degree of freedom, such as the combined bending-torsion.
+type multiDim interface {
+	Dims() int
+}
+
+//Dims returns the number of degrees of freedom on which the potential depends.
+func Dims(p Potential) int {
+	if m, ok := p.(multiDim); ok {
+		return m.Dims()
+	}
+	return 1
+}
+
+//The registry. For each kind of interaction, the potentials are kept in the order they
+//were registered, which is also the order in which they are printed. The first one
+//registered for each kind is the preferred one.
+var potentials = make(map[string][]Potential)
+
+//RegisterPotential adds p to the registry. It panics if a potential with the same
+//kind and function type was already registered.
+func RegisterPotential(p Potential) {
+	if PotentialFor(p.Kind(), p.FuncType()) != nil {
+		panic(fmt.Sprintf("Potential with function type %d already registered for %s", p.FuncType(), p.Kind()))
+	}
+	potentials[p.Kind()] = append(potentials[p.Kind()], p)
+}
+
+//Potentials returns all the potentials registered for the kind of interaction k.
+func Potentials(k string) []Potential {
+	return potentials[k]
+}
+
+//PotentialFor returns the potential registered for the kind k with the GROMACS function type
+//functype, or nil if there is none.
+func PotentialFor(k string, functype int) Potential {
+	for _, v := range potentials[k] {
+		if v.FuncType() == functype {
+			return v
+		}
+	}
+	return nil
+}
+
+//GromacsPar returns a copy of the parameters par, in internal units, converted
+//to the units used by GROMACS.
+func GromacsPar(p Potential, par []float64) []float64 {
+	return convertPar(p, par, chem.Rad2Deg)
+}
+
+//InternalPar returns a copy of the parameters par, in GROMACS units, converted
+//to the internal units.
+func InternalPar(p Potential, par []float64) []float64 {
+	return convertPar(p, par, chem.Deg2Rad)
+}
+
+func convertPar(p Potential, par []float64, factor float64) []float64 {
+	ret := make([]float64, len(par))
+	copy(ret, par)
+	for i, v := range p.ParUnits() {
+		if v == "deg" && i < len(ret) {
+			ret[i] *= factor
+		}
+	}
+	return ret
+}
+
+//The itp lines for 2, 3 and 4 beads, up to the function type.
+func itpBeads(b *bonded) string {
+	bs := b.beads
+	switch len(bs) {
+	case 2:
+		return fmt.Sprintf("%s%3d %-3d %d", b.Comment(), bs[0]+1, bs[1]+1, b.functype)
+	case 3:
+		return fmt.Sprintf("%s%3d     %-3d     %-3d       %2d", b.Comment(), bs[0]+1, bs[1]+1, bs[2]+1, b.functype)
+	default:
+		return fmt.Sprintf("%s%3d     %-3d     %-3d  %-3d       %2d", b.Comment(), bs[0]+1, bs[1]+1, bs[2]+1, bs[3]+1, b.functype)
+	}
+}
+
+/******Harmonic potential, for bonds, angles and impropers******/
+
+type hooke struct {
+	name     string
+	kind     string
+	functype int
+	units    []string
+}
+
+func (h *hooke) Name() string                    { return h.name }
+func (h *hooke) Kind() string                    { return h.kind }
+func (h *hooke) FuncType() int                   { return h.functype }
+func (h *hooke) ParNames() []string              { return []string{"eq", "k"} }
+func (h *hooke) ParUnits() []string              { return h.units }
+func (h *hooke) Guess(x, y []float64) []*float64 { return hookeGuess(x, y) }
+
+func (h *hooke) Energy(par []float64) func(x ...float64) float64 {
+	eq := par[0]
+	k := par[1]
+	return func(x ...float64) float64 { return 0.5 * k * math.Pow((x[0]-eq), 2.0) }
+}
+
+func (h *hooke) Deriv(g, par []float64, x ...float64) {
+	d := x[0] - par[0]
+	g[0] = -par[1] * d
+	g[1] = 0.5 * d * d
+}
+
+//Force constants are positive, distances too, and angles are between 0 and pi.
+//Improper dihedrals can take any value.
+func (h *hooke) Bounds() *ParBounds {
+	B := NewParBounds(2)
+	B.lower[1] = 0
+	switch h.kind {
+	case "bonds":
+		B.lower[0] = 0
+	case "angles":
+		B.lower[0], B.upper[0] = 0, math.Pi
+	}
+	return B
+}
+
+func (h *hooke) ITP(b *bonded) string {
+	if h.kind == "bonds" {
+		return fmt.Sprintf("%3d %-3d 1      %5.3f     %8.2f ; rmsd: %8.2f%s\n", b.beads[0]+1, b.beads[1]+1, b.params[0], b.params[1], b.rmsd, b.Note())
+	}
+	return fmt.Sprintf("%s     %5.2f  %8.2f ; rmsd: %8.2f%s\n", itpBeads(b), b.params[0], b.params[1], b.rmsd, b.Note())
+}
+
+//The improper dihedrals are forced to 180 degrees, if they are close enough to it, or to 0, to avoid
+//a discontinuity in some of the functions.
+type improperHooke struct {
+	hooke
+}
+
+func (h *improperHooke) Fit(x, y []float64, O *OptSettings) ([]float64, float64, error) {
+	par, R2, err := genericFit(h, x, y, O)
+	if err != nil {
+		return par, R2, err
+	}
+	impropTolerance := 10.0 * chem.Deg2Rad
+	if math.Abs(par[0]-math.Pi) < impropTolerance || math.Abs(par[0]) < impropTolerance {
+		eq := math.Pi
+		if math.Abs(par[0]) < impropTolerance {
+			eq = 0
+		}
+		LogV(1, fmt.Sprintf("**The fitted equilibrium angle (%5.3f deg) will be set to %.0f deg! Check that it is close enough to that value\n", par[0]*chem.Rad2Deg, eq*chem.Rad2Deg))
+		//The force constant is fitted again, with the angle fixed, so the parameters, and the RMSD, are those written to the itp.
+		par[0] = eq
+		par[1], R2 = fixedEqHooke(eq, x, y)
+	} else {
+		LogV(1, fmt.Sprintf("**The fitted equilibrium angle (%5.3f deg) is too far from 180 or 0 to set it to 180 so it will", par[0]*chem.Rad2Deg))
+		LogV(1, "be left as-is. This could cause numerical problems in some functions. Check that it is what you want\n")
+	}
+	return par, R2, nil
+}
+
+//fixedEqHooke returns the force constant of the harmonic potential with the equilibrium value eq that best fits
+//the energies y at the points x, by linear least squares, and the RMSD of the fit.
+func fixedEqHooke(eq float64, x, y []float64) (float64, float64) {
+	var num, den float64
+	for i, v := range x {
+		h := 0.5 * (v - eq) * (v - eq)
+		num += y[i] * h
+		den += h * h
+	}
+	k := 0.0
+	if den > 0 {
+		k = math.Max(num/den, 0)
+	}
+	var r2 float64
+	for i, v := range x {
+		r := y[i] - 0.5*k*(v-eq)*(v-eq)
+		r2 += r * r
+	}
+	return k, math.Sqrt(r2 / float64(len(y)))
+}
+
+//Bounds for potentials with an equilibrium angle and a force constant.
+func angleBounds() *ParBounds {
+	B := NewParBounds(2)
+	B.lower[0], B.upper[0] = 0, math.Pi
+	B.lower[1] = 0
+	return B
+}
+
+/******Cosine-based angle potential (GROMOS96)******/
+
+type cosAngle struct{}
+
+func (c *cosAngle) Name() string                    { return "CosAngle" }
+func (c *cosAngle) Kind() string                    { return "angles" }
+func (c *cosAngle) FuncType() int                   { return 2 }
+func (c *cosAngle) ParNames() []string              { return []string{"eq", "k"} }
+func (c *cosAngle) ParUnits() []string              { return []string{"deg", "kJ mol-1"} }
+func (c *cosAngle) Guess(x, y []float64) []*float64 { return cosangleGuess(x, y) }
+
+func (c *cosAngle) Energy(par []float64) func(x ...float64) float64 {
+	ceq := math.Cos(par[0])
+	k := par[1]
+	return func(x ...float64) float64 { return 0.5 * k * math.Pow((math.Cos(x[0])-ceq), 2.0) }
+}
+
+func (c *cosAngle) Deriv(g, par []float64, x ...float64) {
+	d := math.Cos(x[0]) - math.Cos(par[0])
+	g[0] = par[1] * d * math.Sin(par[0])
+	g[1] = 0.5 * d * d
+}
+
+func (c *cosAngle) Bounds() *ParBounds { return angleBounds() }
+
+func (c *cosAngle) ITP(b *bonded) string {
+	return fmt.Sprintf("%s     %5.2f  %8.2f ; Harmonic-Cos (Gromos96) potential rmsd: %8.2f%s\n", itpBeads(b), b.params[0], b.params[1], b.rmsd, b.Note())
+}
+
+/******Restricted bending potential (ReB)*****/
+
+// See: https://pubs.acs.org/doi/abs/10.1021/ct400219n
+type reB struct{}
+
+func (r *reB) Name() string                    { return "ReB" }
+func (r *reB) Kind() string                    { return "reb" }
+func (r *reB) FuncType() int                   { return 10 }
+func (r *reB) ParNames() []string              { return []string{"eq", "k"} }
+func (r *reB) ParUnits() []string              { return []string{"deg", "kJ mol-1"} }
+func (r *reB) Guess(x, y []float64) []*float64 { return reBGuess(x, y) }
+
+func (r *reB) Energy(par []float64) func(x ...float64) float64 {
+	ceq := math.Cos(par[0])
+	k := par[1]
+	return func(x ...float64) float64 {
+		//In the original file we had "eq" instead of "cos(eq)" here. I changed it, because it seems to agree with the
+		//GROMACS manual, so I think the previous behavior was a bug.
+		return 0.5 * k * math.Pow((math.Cos(x[0])-ceq), 2.0) * (1 / math.Pow(math.Sin(x[0]), 2))
+	}
+}
+
+func (r *reB) Deriv(g, par []float64, x ...float64) {
+	d := math.Cos(x[0]) - math.Cos(par[0])
+	s2 := math.Pow(math.Sin(x[0]), 2)
+	g[0] = par[1] * d * math.Sin(par[0]) / s2
+	g[1] = 0.5 * d * d / s2
+}
+
+func (r *reB) Bounds() *ParBounds { return angleBounds() }
+
+func (r *reB) ITP(b *bonded) string {
+	return fmt.Sprintf("%s     %5.2f  %8.2f ; rmsd: %8.2f%s \n", itpBeads(b), b.params[0], b.params[1], b.rmsd, b.Note())
+}
+
+/******Simple periodic potential for dihedrals, k(1+cos(n*phi-eq))******/
+
+type simplePeriodic struct{}
+
+func (s *simplePeriodic) Name() string                    { return "Simple_periodic" }
+func (s *simplePeriodic) Kind() string                    { return "dihe" }
+func (s *simplePeriodic) FuncType() int                   { return 1 }
+func (s *simplePeriodic) ParNames() []string              { return []string{"eq", "k", "n"} }
+func (s *simplePeriodic) ParUnits() []string              { return []string{"deg", "kJ mol-1", ""} }
+func (s *simplePeriodic) Guess(x, y []float64) []*float64 { return simplePeriodicGuess(x, y) }
+
+func (s *simplePeriodic) Energy(par []float64) func(x ...float64) float64 {
+	eq := par[0]
+	k := par[1]
+	n := par[2]
+	return func(x ...float64) float64 { return k * (1 + math.Cos(n*x[0]-eq)) }
+}
+
+func (s *simplePeriodic) Deriv(g, par []float64, x ...float64) {
+	arg := par[2]*x[0] - par[0]
+	g[0] = par[1] * math.Sin(arg)
+	g[1] = 1 + math.Cos(arg)
+	g[2] = -par[1] * x[0] * math.Sin(arg)
+}
+
+//The phase is kept between 0 and 2pi, and the multiplicity is an integer between 1 and 3.
+func (s *simplePeriodic) Bounds() *ParBounds {
+	B := NewParBounds(3)
+	B.lower[0], B.upper[0] = 0, 2*math.Pi
+	B.lower[1] = 0
+	B.lower[2], B.upper[2] = 1, 3
+	B.integer[2] = true
+	return B
+}
+
+func (s *simplePeriodic) ITP(b *bonded) string {
+	n := int(math.Round(b.params[2]))
+	return fmt.Sprintf("%s     %5.2f  %8.2f   %1d ; rmsd: %8.2f%s\n", itpBeads(b), b.params[0], b.params[1], n, b.rmsd, b.Note())
+}
+
+/******Ryckaert-Bellemans potential for dihedrals******/
+
+type ryckBelle struct{}
+
+func (r *ryckBelle) Name() string       { return "Ryckaert-Bellemans" }
+func (r *ryckBelle) Kind() string       { return "dihe" }
+func (r *ryckBelle) FuncType() int      { return 3 }
+func (r *ryckBelle) ParNames() []string { return []string{"C0", "C1", "C2", "C3", "C4", "C5"} }
+func (r *ryckBelle) ParUnits() []string {
+	return []string{"kJ mol-1", "kJ mol-1", "kJ mol-1", "kJ mol-1", "kJ mol-1", "kJ mol-1"}
+}
+func (r *ryckBelle) Guess(x, y []float64) []*float64 { return ryckBelleGuess(x, y) }
+
+func (r *ryckBelle) Energy(p []float64) func(x ...float64) float64 {
+	return func(x ...float64) float64 {
+		cpsi := math.Cos(x[0] - math.Pi) //polymer convention
+		ret := 0.0
+		for j := len(p) - 1; j >= 0; j-- {
+			ret = ret*cpsi + p[j]
+		}
+		return ret
+	}
+}
+
+func (r *ryckBelle) Deriv(g, par []float64, x ...float64) {
+	cpsi := math.Cos(x[0] - math.Pi)
+	g[0] = 1
+	for j := 1; j < len(g); j++ {
+		g[j] = g[j-1] * cpsi
+	}
+}
+
+func (r *ryckBelle) ITP(b *bonded) string {
+	p := b.params
+	return fmt.Sprintf("%s     %5.2f %5.2f %5.2f %5.2f %5.2f %5.2f ;; Ryckaert-Belleman's potential. rmsd: %8.2f%s \n", itpBeads(b), p[0], p[1], p[2], p[3], p[4], p[5], b.rmsd, b.Note())
+}
+
+/******Combined bending-torsion potential******/
+
+//The degrees of freedom are, in order, the torsion and the two bending angles.
+//U = sin^3(theta1)*sin^3(theta2)*sum_n(a_n*cos^n(phi)), with n from 0 to 4.
+type bendingTorsion struct{}
+
+func (c *bendingTorsion) Name() string       { return "Bending-torsion" }
+func (c *bendingTorsion) Kind() string       { return "dihe" }
+func (c *bendingTorsion) FuncType() int      { return 11 }
+func (c *bendingTorsion) Dims() int          { return 3 }
+func (c *bendingTorsion) ParNames() []string { return []string{"a0", "a1", "a2", "a3", "a4"} }
+func (c *bendingTorsion) ParUnits() []string {
+	return []string{"kJ mol-1", "kJ mol-1", "kJ mol-1", "kJ mol-1", "kJ mol-1"}
+}
+
+//ManageBendingTorsion fits this potential by linear least squares, which needs no guess.
+//This one is only used if that fails.
+func (c *bendingTorsion) Guess(x, y []float64) []*float64 {
+	guess := make([]*float64, len(c.ParNames()))
+	for i := range guess {
+		guess[i] = new(float64)
+		*guess[i] = 1.0
+	}
+	return guess
+}
+
+func (c *bendingTorsion) Energy(par []float64) func(x ...float64) float64 {
+	return func(x ...float64) float64 {
+		acc := 0.0
+		for j := len(par) - 1; j >= 0; j-- {
+			acc = acc*math.Cos(x[0]) + par[j]
+		}
+		return math.Pow(math.Sin(x[1]), 3) * math.Pow(math.Sin(x[2]), 3) * acc
+	}
+}
+
+func (c *bendingTorsion) Deriv(g, par []float64, x ...float64) {
+	g[0] = math.Pow(math.Sin(x[1]), 3) * math.Pow(math.Sin(x[2]), 3)
+	for j := 1; j < len(g); j++ {
+		g[j] = g[j-1] * math.Cos(x[0])
+	}
+}
+
+func (c *bendingTorsion) ITP(b *bonded) string {
+	p := b.params
+	return fmt.Sprintf("%s     %5.2f %5.2f %5.2f %5.2f %5.2f ;; Combined bending-torsion potential. rmsd: %8.2f%s \n", itpBeads(b), p[0], p[1], p[2], p[3], p[4], b.rmsd, b.Note())
+}
+
+/******Restricted torsion potential (ReT)******/
+
+//Same functional form as the ReB, but for dihedrals (GROMACS function type 10 in the dihedrals section).
+//The energy diverges at 0 and 180 degrees, so the torsion never gets there.
+type restrictedTorsion struct {
+	reB
+}
+
+func (r *restrictedTorsion) Name() string                    { return "Restricted_torsion" }
+func (r *restrictedTorsion) Kind() string                    { return "dihe" }
+func (r *restrictedTorsion) Guess(x, y []float64) []*float64 { return restrictedTorsionGuess(x, y) }
+
+func (r *restrictedTorsion) ITP(b *bonded) string {
+	return fmt.Sprintf("%s     %5.2f  %8.2f ;; Restricted torsion potential. rmsd: %8.2f%s\n", itpBeads(b), b.params[0], b.params[1], b.rmsd, b.Note())
+}
+
+func init() {
+	RegisterPotential(&hooke{name: "Bond_Hooke", kind: "bonds", functype: 1, units: []string{"nm", "kJ mol-1 nm-2"}})
+	RegisterPotential(&hooke{name: "Angle_Hooke", kind: "angles", functype: 1, units: []string{"deg", "kJ mol-1 rad-2"}})
+	RegisterPotential(new(cosAngle))
+	RegisterPotential(new(reB))
+	RegisterPotential(new(simplePeriodic))
+	RegisterPotential(new(ryckBelle))
+	RegisterPotential(new(restrictedTorsion))
+	RegisterPotential(new(bendingTorsion))
+	RegisterPotential(&improperHooke{hooke{name: "Improper_Hooke", kind: "improp", functype: 2, units: []string{"deg", "kJ mol-1 rad-2"}}})
+}
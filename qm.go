@@ -27,8 +27,8 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 
@@ -37,51 +37,23 @@ import (
 	v3 "github.com/rmera/gochem/v3"
 )
 
-//uses the ree and xtb program to run a replica-exchange simulation
-func REMD(coord *v3.Matrix, mol chem.AtomMultiCharger, MD *MDSettings) string {
-	if MD.method == "" {
-		MD.method = "gfn0" //the default
-	}
-	if MD.temp == 0 {
-		MD.temp = 298.0
-	}
-	if MD.time <= 0 {
-		MD.time = 500
-	}
-	if MD.cpus < 0 {
-		MD.cpus = runtime.NumCPU()
-	}
-	charge := mol.Charge()
-	multi := mol.Multi()
-	if MD.replicas <= 0 {
-		MD.replicas = MD.cpus / 3
-		if MD.replicas < 1 {
-			MD.replicas = 5
-		}
-	}
-	inpgeo := "toree.pdb"
-	err := chem.PDBFileWrite(inpgeo, coord, mol, nil)
-	if err != nil {
-		panic(err.Error())
-	}
-	var reexec string = os.ExpandEnv("${BTROOT}/RE/ree")
-	command := fmt.Sprintf("%s -maxt %5.3f -method %s -cpus %d -charge %d -multi %d -tref %5.3f -dielectric %3.1f -replicas %d %s %d", reexec, MD.maxtemp, MD.method, MD.cpus, charge, multi, MD.temp, MD.dielectric, MD.replicas, inpgeo, MD.time)
-	LogV(2, command) /////////////////////////
-	remd := exec.Command("sh", "-c", command)
-	err = remd.Run()
-	if err != nil {
-		panic(err.Error())
-	}
-	return "fulltraj.xyz"
+//xtbEngine runs the MD with the xtb program, from the Grimme group.
+type xtbEngine struct{}
+
+func (x xtbEngine) Name() string {
+	return "xtb"
+}
 
+func (x xtbEngine) TrajName(S *MDSettings) string {
+	return filepath.Join(S.dir, "xtb.trj")
 }
 
-//This has been tested and seems to work fine.
-//note that the "notused" parameter is only there to keep the same signature as REMD
-func MD(coord *v3.Matrix, mol chem.AtomMultiCharger, MD *MDSettings) string {
+//Run runs the MD with xtb, in the directory MD.dir, or in the current one, if MD.dir is not given.
+//If MD.time is not larger than 0, no MD is run, and the trajectory from a previous run in the same directory is used.
+func (x xtbEngine) Run(coord *v3.Matrix, mol chem.AtomMultiCharger, MD *MDSettings) (*MDOutput, error) {
 	var dry bool = false
-	if _, ok := eps2Solvent[MD.dielectric]; !ok {
-		MD.dielectric = 21.0
+	if MD.solvent == "" {
+		MD.solvent = "acetone" //Want to have an intermediate dielectric.
 	}
 	Q := new(qm.Calc)
 	if MD.method == "" {
@@ -97,47 +69,79 @@ func MD(coord *v3.Matrix, mol chem.AtomMultiCharger, MD *MDSettings) string {
 	if MD.cpus < 0 {
 		MD.cpus = runtime.NumCPU()
 	}
+	MD.SetDefaults()
 	Q.Method = MD.method
-	Q.Dielectric = MD.dielectric //acetone. Want to have an intermediate dielectric. Will be ignored for gfn0 anyway.
+	Q.Dielectric = -1 //the solvent is given to xtb directly, below, as gochem only knows a few of them.
 	Q.Job = qm.Job{MD: true}
 	Q.MDTime = MD.time //simulation time (whatever unit the program uses!) it's ps for xtb
 	Q.MDTemp = MD.temp
-	xtb := qm.NewXTBHandle()
-	xtb.SetnCPU(MD.cpus)
-	err := xtb.BuildInput(coord, mol, Q)
+	xtb, err := newXTBHandle(MD.dir, "gfnMD", MD)
+	if err != nil {
+		return nil, err
+	}
+	err = xtb.BuildInput(coord, mol, Q)
 	if err != nil {
-		panic(err.Error()) //you know the drill
+		return nil, err
+	}
+	//gochem only writes some of the MD settings, so we replace the input it writes.
+	if err := writeXTBMDInput(filepath.Join(MD.dir, "gfnMD.inp"), MD, MD.time, ""); err != nil {
+		return nil, err
 	}
+	trj := x.TrajName(MD) //It's just a multi-xyz file
 	if !dry {
+		os.Remove(trj)      //so we don't pick up an old trajectory if the simulation fails.
 		err = xtb.Run(true) //we wait for the simulation to end, this will take a while!
+		if err != nil {
+			return nil, err
+		}
 	}
 	//We will try to remove scoord files left by xtb, but if it doesn't work, it doesn't work
 	//the program will just keep running.
-	toremove, err := filepath.Glob("scoord*")
+	toremove, err := filepath.Glob(filepath.Join(MD.dir, "scoord*"))
 	if err == nil {
 		for _, f := range toremove {
 			_ = os.Remove(f)
 		}
 	}
-	//I need to check that the thing ran correctly. There is probably some file produced a the
-	//end by xtb for which I can check.
-	if f, err := os.Open("xtb.trj"); err == nil {
-		f.Close()        //just wanted to know if it was there. Surely there is a more direct method, but I'm lazy.
-		return "xtb.trj" //the name of the resulting trajectory. It's just an multi-xyz file
+	//We check that the trajectory is there, at least.
+	if _, err := os.Stat(trj); err != nil {
+		return nil, err
+	}
+	return &MDOutput{engine: x.Name(), trajname: trj, temp: MD.temp, time: MD.time}, nil
+}
+
+//newXTBHandle returns an xtb handle for a calculation with the CPUs, method and solvent in S, in the directory dir
+//(the current one, if dir is empty), with the input files named name. The solvent given in S is used for every method,
+//except gfn0, which doesn't support implicit solvation.
+func newXTBHandle(dir, name string, S *MDSettings) (*qm.XTBHandle, error) {
+	xtb := qm.NewXTBHandle()
+	xtb.SetnCPU(S.cpus)
+	if dir != "" {
+		//xtb writes its trajectory and other files in the directory where it runs,
+		//so we run it in the one requested. The input name must be absolute for that to work.
+		var err error
+		dir, err = filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		xtb.SetName(filepath.Join(dir, name))
+		xtb.SetCommand(fmt.Sprintf("cd %s && %s", dir, xtb.Command()))
+	} else {
+		xtb.SetName(name)
+	}
+	if S.solvent != vacuum && S.solvent != "" {
+		if S.method == "gfn0" {
+			LogV(1, "gfn0 doesn't support implicit solvation. The calculation will be performed in vacuum")
+		} else {
+			xtb.SetCommand(xtb.Command() + " --alpb " + S.solvent)
+		}
 	}
-	panic(err.Error())
+	return xtb, nil
 }
 
-var eps2Solvent = map[float64]string{
-	80.0: "h2o",
-	5.0:  "chcl3",
-	9.0:  "ch2cl2",
-	21.0: "acetone",
-	37.0: "acetonitrile",
-	33.0: "methanol",
-	2.0:  "toluene",
-	7.0:  "thf",
-	47.0: "dmso",
-	38.0: "dmf",
-	-1:   "vac",
+//writeXTBMDInput writes the xtb input file inpname for an MD of the given time, in ps, with the temperature and
+//integration settings in S. The string extra (for instance, other blocks) is written after the $md block.
+func writeXTBMDInput(inpname string, S *MDSettings, time int, extra string) error {
+	md := fmt.Sprintf("$md\n temp=%5.3f\n time=%d\n dump=%g\n step=%g\n hmass=%g\n shake=%d\n velo=false\n nvt=true\n$end\n", S.temp, time, S.dump, S.step, S.hmass, S.shake)
+	return ioutil.WriteFile(inpname, []byte(md+extra), 0644)
 }
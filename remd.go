@@ -0,0 +1,262 @@
+/*
+ * remd.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+)
+
+//The directory where the replica-exchange simulation is run, and the replica list
+//(see ReadReplicaList) it produces, inside that directory.
+const remdDir = "remd"
+const remdListName = "replicas.txt"
+
+//One replica of the replica-exchange simulation. Each replica keeps its temperature, and
+//the configurations are exchanged between them.
+type remdReplica struct {
+	temp   float64
+	dir    string     //absolute path of the directory where the replica's MD is run
+	coord  *v3.Matrix //the current configuration
+	energy float64    //potential energy of the current configuration, kJ/mol
+	traj   string     //the trajectory for this temperature, collected from all segments.
+	err    error
+}
+
+//TempLadder returns n temperatures, geometrically spaced between tmin and tmax, both included.
+//The geometric spacing gives about the same exchange acceptance for all pairs of neighbors.
+func TempLadder(tmin, tmax float64, n int) []float64 {
+	ret := make([]float64, n)
+	ret[0] = tmin
+	if n == 1 {
+		return ret
+	}
+	ratio := math.Pow(tmax/tmin, 1/float64(n-1))
+	for i := 1; i < n; i++ {
+		ret[i] = ret[i-1] * ratio
+	}
+	return ret
+}
+
+//remdEngine runs a replica-exchange MD, using another engine for the MD of each replica.
+type remdEngine struct {
+	inner MDEngine
+}
+
+func (R *remdEngine) Name() string {
+	return "remd-" + R.inner.Name()
+}
+
+func (R *remdEngine) TrajName(S *MDSettings) string {
+	return filepath.Join(S.dir, remdDir, remdListName)
+}
+
+//Run runs a replica-exchange MD. Each replica runs MD segments of MD.exfreq ps, in parallel, in its own directory, within remdDir (itself within MD.dir).
+//The replicas share the MD.cpus CPUs. After each segment, exchanges of configurations between neighboring temperatures are attempted
+//with the Metropolis criterion, using the energy of the last frame of each segment. The trajectory for each temperature is kept,
+//and a list of the replicas, that can be read by ReadReplicaList, is written, as are the exchange statistics.
+//The trajectory in the output is the one at the lowest temperature (MD.temp).
+func (R *remdEngine) Run(coord *v3.Matrix, mol chem.AtomMultiCharger, MD *MDSettings) (*MDOutput, error) {
+	if MD.method == "" {
+		MD.method = "gfn0" //the default
+	}
+	if MD.temp == 0 {
+		MD.temp = 298.0
+	}
+	if MD.time <= 0 {
+		MD.time = 500
+	}
+	if MD.cpus < 0 {
+		MD.cpus = runtime.NumCPU()
+	}
+	if MD.replicas <= 0 {
+		MD.replicas = MD.cpus / 3
+		if MD.replicas < 1 {
+			MD.replicas = 5
+		}
+	}
+	if MD.exfreq <= 0 {
+		MD.exfreq = 2
+	}
+	//Each replica gets an equal share of the CPUs, and we run as many replicas at the same time as the CPUs allow.
+	cpusper := MD.cpus / MD.replicas
+	if cpusper < 1 {
+		cpusper = 1
+	}
+	parallel := MD.cpus / cpusper
+	if parallel < 1 {
+		parallel = 1
+	}
+	root, err := filepath.Abs(filepath.Join(MD.dir, remdDir))
+	if err != nil {
+		return nil, err
+	}
+	reps := make([]*remdReplica, MD.replicas)
+	for i, t := range TempLadder(MD.temp, MD.maxtemp, MD.replicas) {
+		r := &remdReplica{temp: t, dir: filepath.Join(root, fmt.Sprintf("replica%02d", i)), coord: v3.Zeros(coord.NVecs())}
+		r.coord.Copy(coord)
+		r.traj = filepath.Join(root, fmt.Sprintf("replica%02d.xyz", i))
+		if err := os.MkdirAll(r.dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(r.traj); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		reps[i] = r
+	}
+	segments := MD.time / MD.exfreq
+	if segments < 1 {
+		segments = 1
+	}
+	LogV(1, fmt.Sprintf("Replica-exchange MD with %s: %d replicas between %5.1f and %5.1f K, %d segments of %d ps, %d replicas at a time with %d CPUs each", R.inner.Name(), MD.replicas, MD.temp, MD.maxtemp, segments, MD.exfreq, parallel, cpusper))
+	attempts := make([]int, MD.replicas-1)
+	accepted := make([]int, MD.replicas-1)
+	rng := rand.New(rand.NewSource(MD.seed))
+	sem := make(chan bool, parallel)
+	for s := 0; s < segments; s++ {
+		var wg sync.WaitGroup
+		for i, r := range reps {
+			wg.Add(1)
+			sem <- true
+			//each segment of each replica gets its own seed, so the random numbers of stochastic engines are not repeated.
+			seed := MD.seed + int64(1+s*len(reps)+i)
+			go func(r *remdReplica) {
+				defer wg.Done()
+				r.err = r.segment(R.inner, mol, MD, cpusper, seed)
+				<-sem
+			}(r)
+		}
+		wg.Wait()
+		for _, r := range reps {
+			if r.err != nil {
+				return nil, fmt.Errorf("Replica at %5.1f K, segment %d: %s", r.temp, s, r.err.Error())
+			}
+		}
+		//We alternate between exchanges for the even and odd pairs of neighbors.
+		for i := s % 2; i < len(reps)-1; i += 2 {
+			a, b := reps[i], reps[i+1]
+			attempts[i]++
+			delta := (1/(chem.R*a.temp) - 1/(chem.R*b.temp)) * (a.energy - b.energy)
+			if delta >= 0 || rng.Float64() < math.Exp(delta) {
+				accepted[i]++
+				a.coord, b.coord = b.coord, a.coord
+				a.energy, b.energy = b.energy, a.energy
+			}
+		}
+	}
+	if err := writeExchangeStats(reps, attempts, accepted, filepath.Join(root, "exchanges.dat")); err != nil {
+		return nil, err
+	}
+	listname := filepath.Join(root, remdListName)
+	flist, err := os.Create(listname)
+	if err != nil {
+		return nil, err
+	}
+	defer flist.Close()
+	flist.WriteString("#Temperature(K)  trajectory\n")
+	for _, r := range reps {
+		flist.WriteString(fmt.Sprintf("%8.3f  %s\n", r.temp, r.traj))
+	}
+	return &MDOutput{engine: R.Name(), trajname: reps[0].traj, replicas: listname, temp: MD.temp, time: MD.time}, nil
+}
+
+//segment runs one MD segment for the replica, with the given engine and seed, in the replica's directory, from its current
+//configuration, and appends the frames obtained to the replica's trajectory. The configuration and energy of the replica are updated
+//to those of the last frame.
+func (r *remdReplica) segment(engine MDEngine, mol chem.AtomMultiCharger, MD *MDSettings, cpus int, seed int64) error {
+	S := *MD
+	S.temp = r.temp
+	S.time = MD.exfreq
+	S.cpus = cpus
+	S.dir = r.dir
+	S.seed = seed
+	out, err := engine.Run(r.coord, mol, &S)
+	if err != nil {
+		return err
+	}
+	energies, err := XYZEnergies(out.trajname)
+	if err != nil {
+		return err
+	}
+	frames, err := chem.XYZFileRead(out.trajname)
+	if err != nil {
+		return err
+	}
+	if len(energies) == 0 || len(frames.Coords) != len(energies) {
+		return fmt.Errorf("%d frames and %d energies in %s", len(frames.Coords), len(energies), out.trajname)
+	}
+	r.coord = frames.Coords[len(frames.Coords)-1]
+	r.energy = energies[len(energies)-1]
+	return appendFile(r.traj, out.trajname)
+}
+
+//appendFile appends the contents of the file src to the file dst, which is created if needed.
+func appendFile(dst, src string) error {
+	fin, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	fout, err := os.OpenFile(dst, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	_, err = io.Copy(fout, fin)
+	return err
+}
+
+//writeExchangeStats reports the acceptance ratio for the exchanges between each pair of neighboring replicas, and writes them to the file outname.
+func writeExchangeStats(reps []*remdReplica, attempts, accepted []int, outname string) error {
+	fout, err := os.Create(outname)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	fout.WriteString("#T1(K)    T2(K)    attempts accepted ratio\n")
+	for i, v := range attempts {
+		ratio := 0.0
+		if v > 0 {
+			ratio = float64(accepted[i]) / float64(v)
+		}
+		fout.WriteString(fmt.Sprintf("%8.3f %8.3f %5d %5d %5.3f\n", reps[i].temp, reps[i+1].temp, v, accepted[i], ratio))
+		LogV(1, fmt.Sprintf("Exchanges between %5.1f and %5.1f K: %d of %d accepted (%4.1f%%)", reps[i].temp, reps[i+1].temp, accepted[i], v, 100*ratio))
+		if v > 0 && ratio < 0.1 {
+			LogV(0, fmt.Sprintf("Low exchange acceptance between %5.1f and %5.1f K. Consider using more replicas or a lower maximum temperature", reps[i].temp, reps[i+1].temp))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+/*
+ * report.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"time"
+
+	chem "github.com/rmera/gochem"
+)
+
+//ReportParameter is one fitted parameter, in the units of the itp file, with its uncertainties, if available.
+type ReportParameter struct {
+	Name   string   `json:"name"`
+	Unit   string   `json:"unit"`
+	Value  *float64 `json:"value"` //nil (null) if the fit gave a value that is not a finite number
+	StdErr *float64 `json:"stderr,omitempty"`
+	CI     *float64 `json:"ci_half_width,omitempty"`
+}
+
+//ReportInteraction is one fit of a potential to the distribution of a bonded degree of freedom.
+//Every potential fitted for an interaction has its own entry, but only one is selected, i.e., used in the itp file.
+type ReportInteraction struct {
+	Kind             string            `json:"kind"` //bonds, angles, reb, dihe or improp, as in the uncertainties file
+	Category         string            `json:"category"`
+	Beads            []int             `json:"beads"` //1-based, as in the itp
+	Potential        string            `json:"potential"`
+	FuncType         int               `json:"gromacs_function_type"`
+	Parameters       []ReportParameter `json:"parameters,omitempty"`
+	Correlations     [][]*float64      `json:"correlations,omitempty"`
+	RMSD             *float64          `json:"rmsd,omitempty"`
+	Points           int               `json:"fit_points"`
+	Samples          int               `json:"samples"`
+	Selected         bool              `json:"selected"`
+	Commented        bool              `json:"commented"`
+	Constraint       bool              `json:"constraint,omitempty"`
+	Built            bool              `json:"built_from_geometry,omitempty"` //not fitted, see ApplyConstraintPolicy
+	Note             string            `json:"note,omitempty"`
+	Error            string            `json:"error,omitempty"`
+	UncertaintyError string            `json:"uncertainty_error,omitempty"`
+}
+
+//ReportFit are the settings used for the fits.
+type ReportFit struct {
+	Temp        float64            `json:"temperature_K"`
+	Criterion   string             `json:"criterion"`
+	LinearAngle float64            `json:"linear_angle_deg"`
+	Increments  map[string]float64 `json:"bin_widths"` //nm or deg
+	Seed        int64              `json:"seed"`
+	Starts      int                `json:"starts"`
+	Iterations  int                `json:"iterations"`
+	Confidence  float64            `json:"confidence"`
+	Reweighted  bool               `json:"reweighted"`
+}
+
+//Report is the machine-readable version of the results of a run: the settings of the run, and
+//every fitted interaction.
+type Report struct {
+	Program      string              `json:"program"`
+	Created      time.Time           `json:"created"`
+	Command      []string            `json:"command"`
+	Geometry     string              `json:"geometry"`
+	Input        string              `json:"input"`
+	MD           ManifestSettings    `json:"md_settings"`
+	Trajectory   string              `json:"trajectory,omitempty"`
+	Replicas     string              `json:"replica_list,omitempty"`
+	Fit          ReportFit           `json:"fit_settings"`
+	Interactions []ReportInteraction `json:"interactions"`
+}
+
+//jsonFloat returns a pointer to x, or nil if x can't be represented in JSON (NaN or infinite).
+func jsonFloat(x float64) *float64 {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return nil
+	}
+	return &x
+}
+
+//NewReportInteraction returns the report for the fitted interaction b, of the kind k.
+func NewReportInteraction(b *bonded, k string) ReportInteraction {
+	r := ReportInteraction{Kind: k, Category: CategoryName(k), Potential: b.pot.Name(), FuncType: b.functype}
+	for _, v := range b.beads {
+		r.Beads = append(r.Beads, v+1)
+	}
+	r.Points, r.Samples, r.Note, r.Commented = b.npoints, b.samples, b.note, b.commented
+	if b.err != nil {
+		r.Error = err2str(b.err)
+		return r
+	}
+	r.Selected = !b.commented
+	r.RMSD = jsonFloat(b.rmsd)
+	r.Constraint = k == "bonds" && Constrained(b)
+	r.Built = b.built
+	units := b.pot.ParUnits()
+	for i, v := range b.pot.ParNames() {
+		p := ReportParameter{Name: v, Unit: units[i], Value: jsonFloat(b.params[i])}
+		if b.ci != nil {
+			p.StdErr, p.CI = jsonFloat(b.stderr[i]), jsonFloat(b.ci[i])
+		}
+		r.Parameters = append(r.Parameters, p)
+	}
+	r.UncertaintyError = err2str(b.uncerr)
+	if b.corr != nil {
+		n := len(b.params)
+		r.Correlations = make([][]*float64, n)
+		for i := range r.Correlations {
+			r.Correlations[i] = make([]*float64, n)
+			for j := range r.Correlations[i] {
+				r.Correlations[i][j] = jsonFloat(b.corr.At(i, j))
+			}
+		}
+	}
+	return r
+}
+
+//roundDeg converts the angle x, in radians, to degrees, removing the noise from the conversions.
+func roundDeg(x float64) float64 {
+	return math.Round(x*chem.Rad2Deg*1e9) / 1e9
+}
+
+func err2str(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+//PrintReport writes, in JSON format, to the file outname, the settings of the run described by the manifest m and the fit settings FS,
+//and all the interactions in params, including those commented out, or whose fits failed.
+func PrintReport(params map[string][]*bonded, m *Manifest, FS *FitSettings, outname string) {
+	r := &Report{Program: "Bartender - www.github.com/rmera/bartender", Created: time.Now(), Command: m.Command}
+	r.Geometry, r.Input, r.MD = m.Geometry.Name, m.Input.Name, m.Settings
+	r.Trajectory, r.Replicas = m.Trajectory, m.Replicas
+	r.Fit = ReportFit{Temp: FS.temp, Criterion: FS.criterion, LinearAngle: roundDeg(FS.linear), Confidence: confidence, Reweighted: FS.weights != nil}
+	r.Fit.Seed, r.Fit.Starts, r.Fit.Iterations = FS.opt.seed, FS.opt.starts, FS.opt.iterations
+	r.Fit.Increments = make(map[string]float64)
+	for k, v := range FS.increments {
+		if k != "bonds" {
+			v = roundDeg(v)
+		}
+		r.Fit.Increments[k] = v
+	}
+	r.Interactions = make([]ReportInteraction, 0, 10)
+	for _, k := range []string{"bonds", "angles", "reb", "dihe", "improp"} {
+		for _, v := range params[k] {
+			r.Interactions = append(r.Interactions, NewReportInteraction(v, k))
+		}
+	}
+	out, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		panic(err.Error())
+	}
+	if err := ioutil.WriteFile(outname, append(out, '\n'), 0644); err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * reweight.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	chem "github.com/rmera/gochem"
+	"gonum.org/v1/gonum/floats"
+)
+
+//A replica of a replica-exchange simulation: the temperature at which it was sampled, and its trajectory,
+//a multi-XYZ file with the potential energy of each frame in its comment line, as xtb writes it.
+type Replica struct {
+	temp     float64
+	trajname string
+	energies []float64 //kJ/mol
+}
+
+//ReadReplicaList reads a file with one line per replica, containing its temperature, in K, and the name of
+//its trajectory. Empty lines and lines starting with "#" are ignored.
+func ReadReplicaList(name string) ([]*Replica, error) {
+	fin, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	ret := make([]*Replica, 0, 10)
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Malformed line in replica list %s: %s", name, line)
+		}
+		t, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed temperature in replica list %s: %s", name, err.Error())
+		}
+		ret = append(ret, &Replica{temp: t, trajname: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("No replicas in %s", name)
+	}
+	return ret, nil
+}
+
+//XYZEnergies returns the energies, in kJ/mol, in the comment lines of the multi-XYZ file name.
+//The energies are expected in Hartree, after the string "energy:", as xtb writes them.
+func XYZEnergies(name string) ([]float64, error) {
+	fin, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	ret := make([]float64, 0, 100)
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		natoms, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue //blank lines at the end of the file.
+			}
+			return nil, fmt.Errorf("Frame %d of %s: can't read the number of atoms: %s", len(ret)+1, name, err.Error())
+		}
+		if !scanner.Scan() {
+			break
+		}
+		fields := strings.Fields(scanner.Text())
+		e := math.NaN()
+		for i, v := range fields {
+			if v == "energy:" && i+1 < len(fields) {
+				e, err = strconv.ParseFloat(fields[i+1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("Frame %d of %s: can't read the energy: %s", len(ret)+1, name, err.Error())
+				}
+				break
+			}
+		}
+		if math.IsNaN(e) {
+			return nil, fmt.Errorf("Frame %d of %s has no energy in its comment line", len(ret)+1, name)
+		}
+		ret = append(ret, e*chem.H2Kcal*chem.Kcal2KJ)
+		for i := 0; i < natoms; i++ {
+			scanner.Scan()
+		}
+	}
+	return ret, scanner.Err()
+}
+
+//MBARWeights obtains, with the multistate Bennett acceptance ratio (MBAR) method, the weight of each frame of each replica in reps
+//for the ensemble at the temperature target. The replicas must have their energies loaded. The weights are normalized, so their sum is 1,
+//and they are returned in the same order as the frames, replica by replica.
+//As the replicas differ only in their temperatures, the reduced potential of a frame in the state k is simply U/(R*T_k).
+func MBARWeights(reps []*Replica, target float64) ([]float64, error) {
+	K := len(reps)
+	N := make([]float64, K)
+	u := make([]float64, 0, 100) //the potential energies of all frames, all replicas
+	for k, r := range reps {
+		N[k] = float64(len(r.energies))
+		u = append(u, r.energies...)
+	}
+	beta := make([]float64, K)
+	for k, r := range reps {
+		beta[k] = 1 / (chem.R * r.temp)
+	}
+	f := make([]float64, K) //reduced free energies of the states, f[0] is kept at 0
+	logden := make([]float64, len(u))
+	terms := make([]float64, K)
+	//log(sum_k N_k exp(f_k - beta_k*u_n)) for every frame n
+	denominators := func() {
+		for n, v := range u {
+			for k := range terms {
+				terms[k] = math.Log(N[k]) + f[k] - beta[k]*v
+			}
+			logden[n] = floats.LogSumExp(terms)
+		}
+	}
+	nterms := make([]float64, len(u))
+	converged := false
+	for iter := 0; iter < 10000; iter++ {
+		denominators()
+		maxdiff := 0.0
+		newf := make([]float64, K)
+		for k := range f {
+			for n, v := range u {
+				nterms[n] = -beta[k]*v - logden[n]
+			}
+			newf[k] = -floats.LogSumExp(nterms)
+		}
+		for k := range newf {
+			newf[k] -= newf[0]
+			maxdiff = math.Max(maxdiff, math.Abs(newf[k]-f[k]))
+		}
+		f = newf
+		if maxdiff < 1e-8 {
+			converged = true
+			break
+		}
+	}
+	if !converged {
+		return nil, fmt.Errorf("MBAR equations didn't converge")
+	}
+	denominators()
+	bt := 1 / (chem.R * target)
+	w := make([]float64, len(u))
+	for n, v := range u {
+		w[n] = -bt*v - logden[n]
+	}
+	norm := floats.LogSumExp(w)
+	for n := range w {
+		w[n] = math.Exp(w[n] - norm)
+	}
+	return w, nil
+}
+
+//LoadReplicas analyzes the trajectories of all the replicas in the file listname (see ReadReplicaList), and obtains the weight of each frame
+//for the ensemble at the given temperature. It returns the data for all the frames, as TrajAn, and the weights. The contribution
+//of each replica to the reweighted ensemble, and the effective number of frames, are reported, as frames sampled at high temperatures
+//should contribute very little.
+func LoadReplicas(listname string, mol chem.Atomer, beads [][]int, beadweights [][]float64, wanted map[string][][]int, temperature float64) (map[string][][]float64, []float64) {
+	reps, err := ReadReplicaList(listname)
+	if err != nil {
+		panic(err.Error())
+	}
+	var datamap map[string][][]float64
+	for _, r := range reps {
+		r.energies, err = XYZEnergies(r.trajname)
+		if err != nil {
+			panic(err.Error())
+		}
+		_, traj, err := chem.XYZFileAsTraj(r.trajname)
+		if err != nil {
+			panic(err.Error())
+		}
+		d := TrajAn(traj, mol, beads, beadweights, wanted)
+		//every series has one value per frame read, whatever the kind of degree of freedom
+		for _, series := range d {
+			for _, v := range series {
+				if len(v) != len(r.energies) {
+					panic(fmt.Sprintf("Replica %s has %d frames but %d energies", r.trajname, len(v), len(r.energies)))
+				}
+			}
+		}
+		datamap = appendMap(datamap, d)
+	}
+	w, err := MBARWeights(reps, temperature)
+	if err != nil {
+		panic(err.Error())
+	}
+	first := 0
+	for _, r := range reps {
+		last := first + len(r.energies)
+		LogV(1, fmt.Sprintf("Replica at %6.1f K (%s): %d frames, %5.1f%% of the weight at %6.1f K", r.temp, r.trajname, len(r.energies), 100*floats.Sum(w[first:last]), temperature))
+		first = last
+	}
+	LogV(1, fmt.Sprintf("Effective number of frames after reweighting: %6.1f of %d", 1/floats.Dot(w, w), len(w)))
+	return datamap, w
+}
+
+//appendMap appends the series in add to the corresponding ones in datamap, which can be nil.
+func appendMap(datamap, add map[string][][]float64) map[string][][]float64 {
+	if datamap == nil {
+		return add
+	}
+	for k, v := range add {
+		for i, w := range v {
+			datamap[k][i] = append(datamap[k][i], w...)
+		}
+	}
+	return datamap
+}
@@ -0,0 +1,368 @@
+/*
+ * rundir.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+)
+
+//The manifest of a run, in its work directory, and the file where the frames of an interrupted MD are kept.
+const manifestName = "manifest.json"
+const partialName = "partial.trj"
+
+//The states of a run.
+const (
+	runRunning  = "running"  //the MD was started, but it has not finished (maybe it was interrupted)
+	runComplete = "complete" //the trajectory is ready
+)
+
+//ManifestFile is a file used or produced by a run, with its SHA-256 checksum, if it was obtained.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+//ManifestSettings are the settings for the MD of a run, as requested. The MD of a run
+//can only be resumed with the same settings.
+type ManifestSettings struct {
+	Engine   string  `json:"engine"`
+	REMD     bool    `json:"remd"`
+	Time     int     `json:"time_ps"`
+	Method   string  `json:"method"`
+	Temp     float64 `json:"temperature_K"`
+	Solvent  string  `json:"solvent"`
+	Replicas int     `json:"replicas,omitempty"`
+	MaxTemp  float64 `json:"max_temperature_K,omitempty"`
+	ExFreq   int     `json:"exchange_time_ps,omitempty"`
+	Seed     int64   `json:"seed"`
+	PreOpt   bool    `json:"preoptimization"`
+	Confs    int     `json:"conformers,omitempty"`
+	Seeds    int     `json:"seeds"`
+	Step     float64 `json:"time_step_fs"`
+	Dump     float64 `json:"dump_fs"`
+	HMass    float64 `json:"hydrogen_mass_amu"`
+	Shake    int     `json:"shake"`
+	Charge   int     `json:"charge"`
+	Multi    int     `json:"multiplicity"`
+}
+
+//Manifest records the inputs, settings and products of a run. It is written, in JSON format,
+//to the work directory of the run, and it is used to resume an interrupted MD, and to find
+//the trajectory for a refit.
+type Manifest struct {
+	Command    []string         `json:"command"`
+	Started    time.Time        `json:"started"`
+	Updated    time.Time        `json:"updated"`
+	Status     string           `json:"status"`
+	Geometry   ManifestFile     `json:"geometry"`
+	Input      ManifestFile     `json:"input"`
+	Settings   ManifestSettings `json:"md_settings"`
+	Trajectory string           `json:"trajectory,omitempty"`       //absolute path
+	Replicas   string           `json:"replica_list,omitempty"`     //absolute path
+	Parts      []string         `json:"independent_runs,omitempty"` //absolute paths
+	Outputs    []ManifestFile   `json:"outputs,omitempty"`
+	dir        string
+}
+
+//DefaultWorkDir returns the work directory for a run on the geometry in the file geoname.
+//It depends only on the name of the file, so the same directory is used in later runs, to resume or refit.
+func DefaultWorkDir(geoname string) string {
+	base := filepath.Base(geoname)
+	return "bartender_" + strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+//NewManifest returns a new manifest for a run in the work directory dir, with the given geometry and input files,
+//and MD settings, for the molecule mol. The files are not read until the manifest is written.
+func NewManifest(dir, geoname, inpname, engine string, remd bool, S *MDSettings, mol chem.AtomMultiCharger) *Manifest {
+	m := &Manifest{Command: os.Args, Started: time.Now(), Status: runRunning, dir: dir}
+	m.Geometry = ManifestFile{Name: geoname}
+	m.Input = ManifestFile{Name: inpname}
+	m.Settings = ManifestSettings{Engine: engine, REMD: remd, Time: S.time, Method: S.method, Temp: S.temp, Solvent: S.solvent, Seed: S.seed, PreOpt: S.preopt, Confs: S.conformers, Seeds: S.seeds}
+	m.Settings.Step, m.Settings.Dump, m.Settings.HMass, m.Settings.Shake = S.step, S.dump, S.hmass, S.shake
+	m.Settings.Charge, m.Settings.Multi = mol.Charge(), mol.Multi()
+	if remd {
+		m.Settings.Replicas = S.replicas
+		m.Settings.MaxTemp = S.maxtemp
+		m.Settings.ExFreq = S.exfreq
+	}
+	return m
+}
+
+//ReadManifest reads the manifest in the work directory dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := new(Manifest)
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return nil, fmt.Errorf("Malformed manifest in %s: %s", dir, err.Error())
+	}
+	m.dir = dir
+	return m, nil
+}
+
+//Write writes the manifest to its work directory, with the checksums of all the files in it.
+func (m *Manifest) Write() error {
+	m.Updated = time.Now()
+	for _, f := range append([]*ManifestFile{&m.Geometry, &m.Input}, m.outputs()...) {
+		f.SHA256, _ = fileSHA256(f.Name) //files that can't be read just don't get a checksum.
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	//We write a temporary file and then rename it, so an interruption doesn't leave a broken manifest.
+	tmp := filepath.Join(m.dir, manifestName+".tmp")
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.dir, manifestName))
+}
+
+func (m *Manifest) outputs() []*ManifestFile {
+	ret := make([]*ManifestFile, len(m.Outputs))
+	for i := range m.Outputs {
+		ret[i] = &m.Outputs[i]
+	}
+	return ret
+}
+
+//AddOutputs adds the files in names, if they exist, to the outputs of the run.
+func (m *Manifest) AddOutputs(names ...string) {
+	for _, v := range names {
+		if _, err := os.Stat(v); err != nil {
+			continue
+		}
+		m.Outputs = append(m.Outputs, ManifestFile{Name: v})
+	}
+}
+
+//SetOutput records the results of the MD, and marks the run as complete.
+func (m *Manifest) SetOutput(o *MDOutput) {
+	m.Status = runComplete
+	m.Trajectory, m.Replicas = "", ""
+	if o.trajname != "" {
+		m.Trajectory, _ = filepath.Abs(o.trajname)
+	}
+	if o.replicas != "" {
+		m.Replicas, _ = filepath.Abs(o.replicas)
+	}
+	m.Parts = nil
+	for _, v := range o.parts {
+		abs, _ := filepath.Abs(v)
+		m.Parts = append(m.Parts, abs)
+	}
+}
+
+//Output returns the results of the MD of the run, which must be complete.
+func (m *Manifest) Output() (*MDOutput, error) {
+	if m.Status != runComplete {
+		return nil, fmt.Errorf("The MD in %s has not finished (status: %s)", m.dir, m.Status)
+	}
+	return &MDOutput{engine: m.Settings.Engine, trajname: m.Trajectory, replicas: m.Replicas, parts: m.Parts, temp: m.Settings.Temp, time: m.Settings.Time}, nil
+}
+
+//Header returns a description of the MD of the run, in a few lines, to be used in the headers of the output files.
+func (m *Manifest) Header() []string {
+	s := m.Settings
+	if s.Engine == "none" {
+		return []string{fmt.Sprintf("Trajectory not obtained by Bartender: %s%s", m.Trajectory, m.Replicas)}
+	}
+	shake := "unknown"
+	if s.Shake >= 0 && s.Shake <= 2 {
+		shake = []string{"off", "bonds to H", "all bonds"}[s.Shake]
+	}
+	ret := []string{fmt.Sprintf("MD: %s engine, %s method, solvent: %s, %d ps at %.1f K, charge %d, multiplicity %d", s.Engine, s.Method, s.Solvent, s.Time, s.Temp, s.Charge, s.Multi)}
+	ret = append(ret, fmt.Sprintf("MD integration: time step %g fs, frames every %g fs, hydrogen mass %g amu, SHAKE %d (%s), seed %d", s.Step, s.Dump, s.HMass, s.Shake, shake, s.Seed))
+	if s.REMD {
+		ret = append(ret, fmt.Sprintf("Replica exchange: %d replicas up to %.1f K, exchanges every %d ps (0 replicas means automatic)", s.Replicas, s.MaxTemp, s.ExFreq))
+	}
+	if s.PreOpt || s.Confs > 0 || s.Seeds > 1 {
+		ret = append(ret, fmt.Sprintf("Pre-optimization: %t, conformers: %d, independent runs per starting geometry: %d", s.PreOpt, s.Confs, s.Seeds))
+	}
+	return ret
+}
+
+//Resumable returns true if the MD of the run described by m was interrupted, and can be continued by
+//the run described by n, i.e. the settings and the geometry are the same for both.
+func (m *Manifest) Resumable(n *Manifest) bool {
+	if m.Status != runRunning || m.Settings != n.Settings {
+		return false
+	}
+	sum, err := fileSHA256(n.Geometry.Name)
+	return err == nil && sum == m.Geometry.SHA256
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//RunMD runs the MD with the engine. If resume is true, the complete frames left by a previous, interrupted, run of the
+//same engine in the same directory are kept, and the MD is continued from the last of them, for the remaining time. Note that
+//the velocities are not kept, and xtb optimizes the starting geometry, so the continuation is not seamless.
+//Replica-exchange simulations can't be resumed, and are run again from the start.
+func RunMD(engine MDEngine, coord *v3.Matrix, mol chem.AtomMultiCharger, S *MDSettings, resume bool) (*MDOutput, error) {
+	partial := filepath.Join(S.dir, partialName)
+	if _, ok := engine.(*remdEngine); ok && resume {
+		LogV(0, "Replica-exchange simulations can't be resumed. The simulation will be run from the start")
+		resume = false
+	}
+	if !resume {
+		os.Remove(partial)
+		return engine.Run(coord, mol, S)
+	}
+	frames, err := completeFrames(partial, mol.Len())
+	if err != nil {
+		return nil, err
+	}
+	trj := engine.TrajName(S)
+	newframes, err := completeFrames(trj, mol.Len())
+	if err != nil {
+		return nil, err
+	}
+	if err := appendFrames(partial, newframes); err != nil {
+		return nil, err
+	}
+	frames = append(frames, newframes...)
+	S.SetDefaults()
+	done := int(math.Round(float64(len(frames)) * S.dump / 1000)) //S.dump is in fs
+	LogV(1, fmt.Sprintf("Resuming the interrupted MD in %s: %d ps of %d already done", S.dir, done, S.time))
+	if len(frames) > 0 && S.time-done > 0 {
+		last, err := frameCoords(frames[len(frames)-1])
+		if err != nil {
+			return nil, err
+		}
+		coord = last
+	}
+	var out *MDOutput
+	if S.time-done > 0 {
+		R := *S
+		R.time = S.time - done
+		R.seed = S.seed + int64(len(frames)) //so a stochastic engine doesn't repeat the same random numbers.
+		out, err = engine.Run(coord, mol, &R)
+		if err != nil {
+			return nil, err
+		}
+		if err := appendFile(partial, out.trajname); err != nil {
+			return nil, err
+		}
+	} else {
+		out = &MDOutput{engine: engine.Name(), trajname: trj, temp: S.temp}
+	}
+	out.time = S.time
+	return out, os.Rename(partial, out.trajname)
+}
+
+//completeFrames returns the complete frames (as lines of text) in the multi-XYZ file name, with natoms atoms
+//each. A truncated frame at the end of the file is ignored. If the file doesn't exist, no frames are returned.
+func completeFrames(name string, natoms int) ([][]string, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := make([][]string, 0, 100)
+	frame := make([]string, 0, natoms+2)
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return ret, nil //a line without newline at the end was cut, so we ignore it.
+		} else if err != nil {
+			return nil, err
+		}
+		frame = append(frame, strings.TrimRight(line, "\r\n"))
+		if len(frame) < natoms+2 {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(frame[0])); err != nil || n != natoms {
+			return nil, fmt.Errorf("Frame %d of %s is malformed", len(ret)+1, name)
+		}
+		ret = append(ret, frame)
+		frame = make([]string, 0, natoms+2)
+	}
+}
+
+//appendFrames appends the frames, given as lines of text, to the file name, which is created if needed.
+func appendFrames(name string, frames [][]string) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, fr := range frames {
+		for _, l := range fr {
+			w.WriteString(l + "\n")
+		}
+	}
+	return w.Flush()
+}
+
+//frameCoords returns the coordinates in a multi-XYZ frame, given as lines of text.
+func frameCoords(frame []string) (*v3.Matrix, error) {
+	ret := v3.Zeros(len(frame) - 2)
+	for i, l := range frame[2:] {
+		fields := strings.Fields(l)
+		for j := 0; j < 3; j++ {
+			v, err := strconv.ParseFloat(fields[j+1], 64)
+			if err != nil {
+				return nil, err
+			}
+			ret.Set(i, j, v)
+		}
+	}
+	return ret, nil
+}
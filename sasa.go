@@ -0,0 +1,324 @@
+/*
+ * sasa.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+)
+
+//The probe radius, in A, used for the SASAs. The Martini 3 parametrizations use the radius of a tiny bead.
+const sasaProbe = 1.91
+
+//The number of points on the sphere around each atom or bead, for the SASA.
+const sasaPoints = 200
+
+//The grid spacing, in A, for the molecular volumes.
+const volumeSpacing = 0.3
+
+//The van der Waals radii, in A, for the atomistic SASA and volume (Bondi's, with Rowland and Taylor's for hydrogen).
+//Elements not listed get the radius of carbon.
+var vdwRadii = map[string]float64{"H": 1.10, "C": 1.70, "N": 1.55, "O": 1.52, "F": 1.47, "P": 1.80, "S": 1.80, "Cl": 1.75, "Br": 1.85, "I": 1.98, "Se": 1.90, "Si": 2.10}
+
+//The radii, in A, of the Martini 3 beads of each size: regular, small and tiny.
+var martiniRadii = map[string]float64{"R": 2.64, "S": 2.30, "T": 1.91}
+
+//BeadSize returns the Martini 3 size for the bead formed by the atoms indexes of mol, with the given weights: regular (R) for 4 or more
+//heavy atoms, small (S) for 3, and tiny (T) for 2 or less. Shared atoms count according to their weights.
+func BeadSize(mol chem.Atomer, indexes []int, weights []float64) string {
+	heavy := 0.0
+	for i, v := range indexes {
+		if mol.Atom(v).Symbol != "H" {
+			heavy += weights[i]
+		}
+	}
+	switch {
+	case heavy >= 3.5:
+		return "R"
+	case heavy >= 2.5:
+		return "S"
+	}
+	return "T"
+}
+
+//sphereDirections returns n unit vectors evenly spread on a sphere (the golden spiral).
+func sphereDirections(n int) [][3]float64 {
+	ret := make([][3]float64, n)
+	golden := math.Pi * (3 - math.Sqrt(5))
+	for i := range ret {
+		z := 1 - 2*(float64(i)+0.5)/float64(n)
+		r := math.Sqrt(1 - z*z)
+		phi := golden * float64(i)
+		ret[i] = [3]float64{r * math.Cos(phi), r * math.Sin(phi), z}
+	}
+	return ret
+}
+
+//SASA returns the solvent accessible surface area, in A^2, of the spheres with centers pos and the given radii, for the probe radius
+//probe, by the Shrake-Rupley method, with the points on the unit sphere dirs.
+func SASA(pos [][3]float64, radii []float64, probe float64, dirs [][3]float64) float64 {
+	total := 0.0
+	neighbors := make([]int, 0, len(pos))
+	for i, p := range pos {
+		ri := radii[i] + probe
+		neighbors = neighbors[:0]
+		for j, q := range pos {
+			if j != i && sqDist(p, q) < math.Pow(ri+radii[j]+probe, 2) {
+				neighbors = append(neighbors, j)
+			}
+		}
+		free := 0
+		for _, d := range dirs {
+			pt := [3]float64{p[0] + ri*d[0], p[1] + ri*d[1], p[2] + ri*d[2]}
+			buried := false
+			for _, j := range neighbors {
+				if sqDist(pt, pos[j]) < math.Pow(radii[j]+probe, 2) {
+					buried = true
+					break
+				}
+			}
+			if !buried {
+				free++
+			}
+		}
+		total += 4 * math.Pi * ri * ri * float64(free) / float64(len(dirs))
+	}
+	return total
+}
+
+//Volume returns the volume, in A^3, of the union of the spheres with centers pos and the given radii, obtained by counting
+//the points of a grid with the given spacing that are inside any sphere.
+func Volume(pos [][3]float64, radii []float64, spacing float64) float64 {
+	var lo, hi [3]float64
+	for j := range lo {
+		lo[j], hi[j] = math.Inf(1), math.Inf(-1)
+	}
+	for i, p := range pos {
+		for j := range p {
+			lo[j] = math.Min(lo[j], p[j]-radii[i])
+			hi[j] = math.Max(hi[j], p[j]+radii[i])
+		}
+	}
+	var n [3]int
+	for j := range n {
+		n[j] = int(math.Ceil((hi[j]-lo[j])/spacing)) + 1
+	}
+	inside := make([]bool, n[0]*n[1]*n[2])
+	count := 0
+	for i, p := range pos {
+		r := radii[i]
+		var from, to [3]int
+		for j := range p {
+			from[j] = int(math.Max(0, math.Floor((p[j]-r-lo[j])/spacing)))
+			to[j] = int(math.Min(float64(n[j]-1), math.Ceil((p[j]+r-lo[j])/spacing)))
+		}
+		for x := from[0]; x <= to[0]; x++ {
+			for y := from[1]; y <= to[1]; y++ {
+				for z := from[2]; z <= to[2]; z++ {
+					pt := [3]float64{lo[0] + float64(x)*spacing, lo[1] + float64(y)*spacing, lo[2] + float64(z)*spacing}
+					idx := (x*n[1]+y)*n[2] + z
+					if !inside[idx] && sqDist(pt, p) <= r*r {
+						inside[idx] = true
+						count++
+					}
+				}
+			}
+		}
+	}
+	return float64(count) * math.Pow(spacing, 3)
+}
+
+func sqDist(a, b [3]float64) float64 {
+	return (a[0]-b[0])*(a[0]-b[0]) + (a[1]-b[1])*(a[1]-b[1]) + (a[2]-b[2])*(a[2]-b[2])
+}
+
+//scaled returns a copy of pos, scaled by s around its center, so all the distances are multiplied by s.
+func scaled(pos [][3]float64, s float64) [][3]float64 {
+	var c [3]float64
+	for _, p := range pos {
+		for j := range c {
+			c[j] += p[j] / float64(len(pos))
+		}
+	}
+	ret := make([][3]float64, len(pos))
+	for i, p := range pos {
+		for j := range p {
+			ret[i][j] = c[j] + s*(p[j]-c[j])
+		}
+	}
+	return ret
+}
+
+//SASAResult contains the averaged SASAs, in A^2, and volumes, in A^3, of the atomistic and CG (mapped) models, and
+//the factor by which the bond lengths of the CG model have to be scaled for its SASA to match the atomistic one.
+type SASAResult struct {
+	frames   int
+	aaSASA   float64
+	aaVolume float64
+	cgSASA   float64 //unscaled
+	cgVolume float64
+	scale    float64
+	scSASA   float64 //at the scale factor
+	scVolume float64
+}
+
+//SASAAnalysis obtains the SASAs and volumes of the molecule mol and of its CG model (the beads given by indexes and weights, placed
+//at the centers of their atoms, with the radii of Martini 3 beads of the corresponding size) averaged over every skip-th frame of
+//traj. It also finds the factor by which the distances between the beads (so, the bond lengths) have to be scaled for the CG SASA
+//to match the atomistic one, as done in the Martini 3 parametrizations.
+func SASAAnalysis(traj chem.Traj, mol chem.Atomer, indexes [][]int, weights [][]float64, skip int) (*SASAResult, error) {
+	dirs := sphereDirections(sasaPoints)
+	aaradii := make([]float64, mol.Len())
+	for i := range aaradii {
+		r, ok := vdwRadii[mol.Atom(i).Symbol]
+		if !ok {
+			r = vdwRadii["C"]
+		}
+		aaradii[i] = r
+	}
+	cgradii := make([]float64, len(indexes))
+	for i, v := range indexes {
+		cgradii[i] = martiniRadii[BeadSize(mol, v, weights[i])]
+	}
+	R := new(SASAResult)
+	cgpos := make([][][3]float64, 0, 100) //the bead positions in every frame used, to find the scale factor.
+	coord := v3.Zeros(traj.Len())
+	var err error
+	for i := 0; ; i++ {
+		if i%skip != 0 {
+			if err = traj.Next(nil); err != nil {
+				break
+			}
+			continue
+		}
+		if err = traj.Next(coord); err != nil {
+			break
+		}
+		aapos := make([][3]float64, coord.NVecs())
+		for j := range aapos {
+			aapos[j] = [3]float64{coord.At(j, 0), coord.At(j, 1), coord.At(j, 2)}
+		}
+		beads := make([][3]float64, len(indexes))
+		for j, v := range indexes {
+			c := WCOM(coord, mol, v, weights[j])
+			beads[j] = [3]float64{c.At(0, 0), c.At(0, 1), c.At(0, 2)}
+		}
+		R.aaSASA += SASA(aapos, aaradii, sasaProbe, dirs)
+		R.aaVolume += Volume(aapos, aaradii, volumeSpacing)
+		cgpos = append(cgpos, beads)
+	}
+	if _, ok := err.(chem.LastFrameError); !ok {
+		return nil, err
+	}
+	R.frames = len(cgpos)
+	if R.frames == 0 {
+		return nil, fmt.Errorf("No frames read for the SASA analysis")
+	}
+	R.aaSASA /= float64(R.frames)
+	R.aaVolume /= float64(R.frames)
+	cg := func(s float64) (float64, float64) {
+		var sasa, vol float64
+		for _, v := range cgpos {
+			p := scaled(v, s)
+			sasa += SASA(p, cgradii, sasaProbe, dirs)
+			vol += Volume(p, cgradii, volumeSpacing)
+		}
+		return sasa / float64(R.frames), vol / float64(R.frames)
+	}
+	R.cgSASA, R.cgVolume = cg(1)
+	//The SASA grows with the scale factor, so we find it by bisection, if the factor is in the bracket.
+	lo, hi := 0.5, 2.0
+	slo, _ := cg(lo)
+	shi, _ := cg(hi)
+	if R.aaSASA < slo || R.aaSASA > shi {
+		LogV(0, fmt.Sprintf("The atomistic SASA (%.1f A^2) can't be matched scaling the bonds by %.1f-%.1f (CG SASA %.1f-%.1f A^2). The bonds will not be scaled", R.aaSASA, lo, hi, slo, shi))
+		R.scale = 1
+		R.scSASA, R.scVolume = R.cgSASA, R.cgVolume
+		return R, nil
+	}
+	for hi-lo > 0.001 {
+		mid := (lo + hi) / 2
+		if s, _ := cg(mid); s < R.aaSASA {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	R.scale = math.Round((lo+hi)*500) / 1000
+	R.scSASA, R.scVolume = cg(R.scale)
+	return R, nil
+}
+
+//Write reports the results, and writes them to the tab-separated file outname.
+func (R *SASAResult) Write(outname string) error {
+	lines := [][2]string{
+		{"frames", fmt.Sprintf("%d", R.frames)},
+		{"probe_radius_A", fmt.Sprintf("%.2f", sasaProbe)},
+		{"aa_sasa_A2", fmt.Sprintf("%.2f", R.aaSASA)},
+		{"cg_sasa_A2", fmt.Sprintf("%.2f", R.cgSASA)},
+		{"aa_volume_A3", fmt.Sprintf("%.2f", R.aaVolume)},
+		{"cg_volume_A3", fmt.Sprintf("%.2f", R.cgVolume)},
+		{"bond_scale", fmt.Sprintf("%.3f", R.scale)},
+		{"scaled_cg_sasa_A2", fmt.Sprintf("%.2f", R.scSASA)},
+		{"scaled_cg_volume_A3", fmt.Sprintf("%.2f", R.scVolume)},
+	}
+	LogV(0, fmt.Sprintf("SASA (%d frames): atomistic %.1f A^2, CG %.1f A^2 (%+.1f%%). Volume: atomistic %.1f A^3, CG %.1f A^3 (%+.1f%%)", R.frames, R.aaSASA, R.cgSASA, 100*(R.cgSASA-R.aaSASA)/R.aaSASA, R.aaVolume, R.cgVolume, 100*(R.cgVolume-R.aaVolume)/R.aaVolume))
+	LogV(0, fmt.Sprintf("Scaling the bond lengths by %.3f gives a CG SASA of %.1f A^2, and a CG volume of %.1f A^3", R.scale, R.scSASA, R.scVolume))
+	fout, err := os.Create(outname)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	fout.WriteString("# SASA and volume comparison by Bartender - www.github.com/rmera/bartender\n")
+	for _, v := range lines {
+		fout.WriteString(v[0] + "\t" + v[1] + "\n")
+	}
+	return nil
+}
+
+//ScaleBonds multiplies the lengths of all the bonds and constraints in params, and their uncertainties, by s.
+func ScaleBonds(params map[string][]*bonded, s float64) {
+	for _, v := range params["bonds"] {
+		if v.err != nil {
+			continue
+		}
+		v.params[0] *= s
+		if v.ci != nil {
+			v.ci[0] *= s
+			v.stderr[0] *= s
+		}
+		note := fmt.Sprintf("length scaled by %.3f to match the atomistic SASA", s)
+		if v.note != "" {
+			note = v.note + "; " + note
+		}
+		v.note = note
+	}
+}
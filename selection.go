@@ -0,0 +1,104 @@
+/*
+ * selection.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+//InfoCriterion returns the value of the information criterion crit ("aic" or "bic") for a least-squares fit
+//with npar parameters to npoints points, with the given RMSD. Assuming normally-distributed residues,
+//the log-likelihood is, up to a constant, -n/2*ln(RSS/n). For the AIC, the small-sample correction (AICc) is
+//used whenever possible, as we seldom have many more points than parameters.
+func InfoCriterion(crit string, rmsd float64, npoints, npar int) float64 {
+	n := float64(npoints)
+	k := float64(npar)
+	rss := rmsd * rmsd * n
+	if rss <= 0 {
+		rss = 1e-12 //a perfect fit. Shouldn't happen with real data.
+	}
+	m2lnL := n * math.Log(rss/n) //-2 times the log-likelihood, up to a constant
+	if crit == "bic" {
+		return m2lnL + k*math.Log(n)
+	}
+	aic := m2lnL + 2*k
+	if n-k-1 > 0 {
+		aic += 2 * k * (k + 1) / (n - k - 1)
+	}
+	return aic
+}
+
+//SelectModel leaves uncommented only the candidate with the lowest value of the information criterion crit.
+//The rest are commented out. The rationale for the selection is added to the note of each candidate.
+//It returns the index of the selected candidate, or -1 if candidates is empty.
+func SelectModel(candidates []*bonded, crit string) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	if len(candidates) == 1 {
+		candidates[0].commented = candidates[0].err != nil
+		return 0
+	}
+	name := strings.ToUpper(crit)
+	ics := make([]float64, len(candidates))
+	best := -1
+	for i, v := range candidates {
+		ics[i] = math.Inf(1) //failed fits are never selected
+		if v.err == nil {
+			ics[i] = InfoCriterion(crit, v.rmsd, v.npoints, len(v.params))
+		}
+		if best < 0 || ics[i] < ics[best] {
+			best = i
+		}
+	}
+	//the runner-up, to report how clear the choice was.
+	second := -1
+	for i := range candidates {
+		if i != best && (second < 0 || ics[i] < ics[second]) {
+			second = i
+		}
+	}
+	if candidates[best].err != nil {
+		return -1 //all of them failed
+	}
+	b := candidates[best]
+	for i, v := range candidates {
+		v.commented = i != best
+		if i != best && v.err == nil {
+			v.note = fmt.Sprintf("%s=%.2f, %.2f above %s", name, ics[i], ics[i]-ics[best], b.pot.Name())
+		}
+	}
+	if candidates[second].err != nil {
+		b.note = fmt.Sprintf("selected, as the fit for %s failed", candidates[second].pot.Name())
+		return best
+	}
+	b.note = fmt.Sprintf("selected by %s=%.2f, %.2f below %s", name, ics[best], ics[second]-ics[best], candidates[second].pot.Name())
+	LogV(1, fmt.Sprintf("%s potential selected for beads %s by %s. Next best: %s, with %s %.2f higher", b.pot.Name(), BeadsText(b.beads), name, candidates[second].pot.Name(), name, ics[second]-ics[best]))
+	return best
+}
@@ -0,0 +1,219 @@
+/*
+ * solvent.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+//The name used for calculations without implicit solvent.
+const vacuum = "vac"
+
+//An implicit solvent, with its dielectric constant.
+type solvent struct {
+	name string
+	eps  float64
+}
+
+//The solvents available for the ALPB model in xtb, with their dielectric constants.
+var alpbSolvents = []solvent{
+	{"acetone", 20.7},
+	{"acetonitrile", 37.5},
+	{"aniline", 6.89},
+	{"benzaldehyde", 17.85},
+	{"benzene", 2.27},
+	{"ch2cl2", 8.93},
+	{"chcl3", 4.71},
+	{"cs2", 2.64},
+	{"dioxane", 2.21},
+	{"dmf", 37.0},
+	{"dmso", 46.7},
+	{"ether", 4.34},
+	{"ethylacetate", 5.99},
+	{"furane", 2.94},
+	{"hexadecane", 2.04},
+	{"hexane", 1.88},
+	{"methanol", 32.7},
+	{"nitromethane", 36.6},
+	{"octanol", 9.86},
+	{"woctanol", 8.1},
+	{"phenol", 9.78},
+	{"toluene", 2.38},
+	{"thf", 7.43},
+	{"h2o", 80.2},
+}
+
+//Other names accepted for some solvents.
+var solventAliases = map[string]string{
+	"water":      "h2o",
+	"vacuum":     vacuum,
+	"gas":        vacuum,
+	"none":       vacuum,
+	"dcm":        "ch2cl2",
+	"chloroform": "chcl3",
+}
+
+//FindSolvent returns the solvent with the given name, which is not case-sensitive.
+func FindSolvent(name string) (solvent, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if v, ok := solventAliases[name]; ok {
+		name = v
+	}
+	if name == vacuum {
+		return solvent{name: vacuum, eps: 1}, nil
+	}
+	for _, v := range alpbSolvents {
+		if v.name == name {
+			return v, nil
+		}
+	}
+	names := make([]string, len(alpbSolvents))
+	for i, v := range alpbSolvents {
+		names[i] = v.name
+	}
+	return solvent{}, fmt.Errorf("Unknown solvent %s. The available ones are: %s and %s", name, strings.Join(names, ", "), vacuum)
+}
+
+//NearestSolvent returns the solvent with the dielectric constant closest to eps. A negative eps means no solvent.
+//It warns if the dielectric constant of the solvent returned is not within 1 of eps.
+func NearestSolvent(eps float64) solvent {
+	if eps < 0 {
+		return solvent{name: vacuum, eps: 1}
+	}
+	ret := alpbSolvents[0]
+	for _, v := range alpbSolvents[1:] {
+		if math.Abs(v.eps-eps) < math.Abs(ret.eps-eps) {
+			ret = v
+		}
+	}
+	if math.Abs(ret.eps-eps) > 1 {
+		LogV(0, fmt.Sprintf("No solvent with a dielectric constant of %.2f is available. The nearest one, %s (%.2f), will be used", eps, ret.name, ret.eps))
+	}
+	return ret
+}
+
+//ParseSolvents returns the solvents in the comma-separated list names, sorted by increasing dielectric constant.
+//If names is empty, the solvent with the dielectric constant nearest to eps is returned.
+func ParseSolvents(names string, eps float64) ([]solvent, error) {
+	if strings.TrimSpace(names) == "" {
+		return []solvent{NearestSolvent(eps)}, nil
+	}
+	ret := make([]solvent, 0, 3)
+	for _, v := range strings.Split(names, ",") {
+		s, err := FindSolvent(v)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].eps < ret[j].eps })
+	return ret, nil
+}
+
+//SolventReport writes a tab-separated file with the parameters obtained in each of the solvents (sorted by increasing dielectric constant)
+//for every interaction, using the potential selected for it in each solvent. results contains the parameters for each solvent, as returned by FitAll.
+//Parameters whose values in two solvents differ by more than the sum of their confidence intervals are reported as depending on the solvent.
+func SolventReport(results map[string]map[string][]*bonded, solvents []solvent, outname string) {
+	fout, err := os.Create(outname)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer fout.Close()
+	fout.WriteString("# Bonded parameters in several solvents by Bartender - www.github.com/rmera/bartender\n")
+	header := "# kind\tbeads\tpotential\tparameter\tunit"
+	for _, s := range solvents {
+		header += fmt.Sprintf("\t%s(eps=%.2f)\t%s_ci%2.0f", s.name, s.eps, s.name, confidence*100)
+	}
+	fout.WriteString(header + "\tsolvent_dependent\n")
+	first := results[solvents[0].name]
+	for _, k := range []string{"bonds", "angles", "reb", "dihe", "improp"} {
+		for _, b := range first[k] {
+			if b.commented || b.err != nil {
+				continue
+			}
+			//the same interaction, with the same potential, in each solvent.
+			same := make([]*bonded, len(solvents))
+			for i, s := range solvents {
+				same[i] = selectedBonded(results[s.name][k], b)
+			}
+			beads := strings.TrimSpace(BeadsText(b.beads))
+			units := b.pot.ParUnits()
+			for p, name := range b.pot.ParNames() {
+				line := fmt.Sprintf("%s\t%s\t%s\t%s\t%s", k, beads, b.pot.Name(), name, units[p])
+				for _, v := range same {
+					val, ci := math.NaN(), math.NaN()
+					if v != nil {
+						val = v.params[p]
+						if v.ci != nil {
+							ci = v.ci[p]
+						}
+					}
+					line += fmt.Sprintf("\t%g\t%g", val, ci)
+				}
+				dep := solventDependent(same, p)
+				if dep {
+					LogV(1, fmt.Sprintf("The parameter %s of the %s potential for the %s between beads %s changes with the solvent", name, b.pot.Name(), CategoryName(k), beads))
+				}
+				fout.WriteString(fmt.Sprintf("%s\t%t\n", line, dep))
+			}
+		}
+	}
+}
+
+//selectedBonded returns the bonded in list for the same beads as b, and with the same potential, if it was the one selected
+//and its fit didn't fail. Otherwise, it returns nil.
+func selectedBonded(list []*bonded, b *bonded) *bonded {
+	for _, v := range list {
+		if v.pot.Name() == b.pot.Name() && BeadsText(v.beads) == BeadsText(b.beads) && !v.commented && v.err == nil {
+			return v
+		}
+	}
+	return nil
+}
+
+//solventDependent returns true if the values of the parameter p in any two of the bondeds differ by more than the sum
+//of their confidence intervals. Bondeds that are nil, or for which there are no confidence intervals, are not considered.
+func solventDependent(bs []*bonded, p int) bool {
+	for i, a := range bs {
+		if a == nil || a.ci == nil {
+			continue
+		}
+		for _, b := range bs[i+1:] {
+			if b == nil || b.ci == nil {
+				continue
+			}
+			if math.Abs(a.params[p]-b.params[p]) > a.ci[p]+b.ci[p] {
+				return true
+			}
+		}
+	}
+	return false
+}
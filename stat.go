@@ -27,16 +27,27 @@
 package main
 
 import (
+	"fmt"
 	"math"
 	"sort"
 
 	chem "github.com/rmera/gochem"
+	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/stat"
 )
 
 //takes a slice with values (angles, distances, dihedrals) and, from their relative abundance, obtains an energy
-func IBoltzmann(inp []float64, increment, temperature float64) ([]float64, []float64) {
-	sort.Float64s(inp)
+//inp is not modified. If weights is not nil, each value in inp is counted with the corresponding weight
+//(for instance, to reweight the frames of a replica-exchange simulation to the temperature given).
+func IBoltzmann(inp []float64, increment, temperature float64, weights []float64) ([]float64, []float64) {
+	//we sort a copy, so the correspondence with other distributions is kept.
+	inp = append([]float64(nil), inp...)
+	if weights != nil {
+		weights = append([]float64(nil), weights...)
+		sort.Sort(weightedSort{inp, weights})
+	} else {
+		sort.Float64s(inp)
+	}
 	divs := make([]float64, 0, 10)
 	hpoints := make([]float64, 0, 10)
 	for i := inp[0] - increment; i <= inp[len(inp)-1]+increment; i += increment {
@@ -47,7 +58,7 @@ func IBoltzmann(inp []float64, increment, temperature float64) ([]float64, []flo
 	}
 	//	fmt.Println(hpoints) //////////////
 	histo := make([]float64, len(divs)-1)
-	histo = stat.Histogram(histo, divs, inp, nil)
+	histo = stat.Histogram(histo, divs, inp, weights)
 
 	//	fmt.Println(histo) /////
 	//now we invert the Maxwell-Boltzmann distribution to
@@ -76,136 +87,146 @@ func IBoltzmann(inp []float64, increment, temperature float64) ([]float64, []flo
 
 }
 
-type bendtor struct {
-	b1  []float64
-	b2  []float64
-	tor []float64
-}
-
-func Newbendtor(N int) *bendtor {
-	bt := new(bendtor)
-	bt.tor = make([]float64, N, N)
-	bt.b1 = make([]float64, N, N)
-	bt.b2 = make([]float64, N, N)
-	return bt
+//Sorts values, and the corresponding weights, by value.
+type weightedSort struct {
+	values  []float64
+	weights []float64
 }
 
-type bendtorFreq struct {
-	tor []float64
-	b1  []float64
-	b2  []float64
-	n   int
-	e   float64
+func (w weightedSort) Len() int           { return len(w.values) }
+func (w weightedSort) Less(i, j int) bool { return w.values[i] < w.values[j] }
+func (w weightedSort) Swap(i, j int) {
+	w.values[i], w.values[j] = w.values[j], w.values[i]
+	w.weights[i], w.weights[j] = w.weights[j], w.weights[i]
 }
 
-func NewbendtorFreq() *bendtorFreq {
-	r := new(bendtorFreq)
-	r.tor = make([]float64, 2, 2)
-	r.b1 = make([]float64, 2, 2)
-	r.b2 = make([]float64, 2, 2)
-	r.n = 0 //not reaaally needed
-	return r
+//JointHistogram is a histogram for the joint distribution of several variables (say, a torsion
+//and the two bending angles around it). Each sample is assigned to its bin directly, from its
+//coordinates, and only the non-empty bins are stored, so the cost is linear in the number of samples,
+//and the memory, in the number of occupied bins, regardless of the number of dimensions.
+type JointHistogram struct {
+	lower   []float64       //lower edge of the first bin, for each dimension
+	width   []float64       //bin widths, for each dimension
+	nbins   []int           //number of bins for each dimension
+	counts  map[int]float64 //(weighted) counts for the non-empty bins, indexed by the linear index of the bin
+	samples float64         //total (weighted) number of samples
 }
 
-type freqs []*bendtorFreq
-
-func (f freqs) LargestFreq() int {
-	var largest int
-	for _, v := range f {
-		if v.n > largest {
-			largest = v.n
+//NewJointHistogram builds the histogram for the data, which has a slice per dimension (variable),
+//with one element per sample, and the bin widths given for each dimension. If weights is not nil, each sample
+//is counted with its weight. It panics if the slices in data don't have all the same length, or if there are
+//not as many widths as dimensions.
+func NewJointHistogram(data [][]float64, widths, weights []float64) *JointHistogram {
+	if len(data) != len(widths) {
+		panic(fmt.Sprintf("NewJointHistogram: %d dimensions but %d bin widths", len(data), len(widths)))
+	}
+	H := &JointHistogram{lower: make([]float64, len(data)), width: widths, nbins: make([]int, len(data)), counts: make(map[int]float64)}
+	total := 1
+	for i, v := range data {
+		if len(v) != len(data[0]) {
+			panic(fmt.Sprintf("NewJointHistogram: dimension %d has %d samples, expected %d", i, len(v), len(data[0])))
+		}
+		if len(v) == 0 {
+			return H
 		}
+		H.lower[i] = floats.Min(v)
+		H.nbins[i] = int((floats.Max(v)-H.lower[i])/widths[i]) + 1
+		if total > math.MaxInt32/H.nbins[i] {
+			panic("NewJointHistogram: too many bins, use larger widths")
+		}
+		total *= H.nbins[i]
 	}
-	return largest
-}
-
-func (f freqs) removeZeros() freqs {
-	f2 := make([]*bendtorFreq, 0, len(f))
-	for _, v := range f {
-		if v.n != 0 {
-			f2 = append(f2, v)
+	for j := range data[0] {
+		index := 0
+		for i, v := range data {
+			index = index*H.nbins[i] + H.bin(i, v[j])
 		}
+		w := 1.0
+		if weights != nil {
+			w = weights[j]
+		}
+		H.counts[index] += w
+		H.samples += w
 	}
-	return freqs(f2)
+	return H
 }
 
-//If any of this fails, check that I didn't copy-paste the variables wront (i.e. assigned b1 to tor, for instance).
-
-//returns the values in f but as 3 separate, matching, slices of torsions, bend1, bend2 and energies.
-func (f freqs) tbbe() ([]float64, []float64, []float64, []float64) {
-	t := make([]float64, 0, len(f))
-	b1 := make([]float64, 0, len(f))
-	b2 := make([]float64, 0, len(f))
-	e := make([]float64, 0, len(f))
-	for _, v := range f {
-		tor := (v.tor[0] - v.tor[1]) / 2
-		bend1 := (v.b2[0] - v.b1[1]) / 2
-		bend2 := (v.b2[0] - v.b2[1]) / 2
-		t = append(t, tor)
-		b1 = append(b1, bend1)
-		b2 = append(b2, bend2)
-		e = append(e, v.e)
+//bin returns the bin in which the value v falls, for the dimension dim.
+func (H *JointHistogram) bin(dim int, v float64) int {
+	b := int((v - H.lower[dim]) / H.width[dim])
+	if b >= H.nbins[dim] { //only rounding errors could get us here.
+		b = H.nbins[dim] - 1
 	}
-	return t, b1, b2, e
+	return b
+}
 
+//Len returns the number of non-empty bins
+func (H *JointHistogram) Len() int {
+	return len(H.counts)
 }
 
-//CountAngles will search bt and count all the elements that have the torsion and 2 angles
-//within the ranges specified in AF. The final count will be loaded to the "N" field of AF
-//and the same -modified- AF will be returned.
-func CountAngles(AF *bendtorFreq, bt *bendtor) *bendtorFreq {
-	for i, v := range bt.tor {
-		if v >= AF.tor[0] && v < AF.tor[1] {
-			if bt.b1[i] >= AF.b1[0] && bt.b1[i] < AF.b1[1] {
-				if bt.b2[i] >= AF.b2[0] && bt.b2[i] < AF.b2[1] {
-					AF.n++
-				}
-
-			}
+//Entropy returns the Shannon entropy, in nats, of the distribution given by the histogram.
+func (H *JointHistogram) Entropy() float64 {
+	ret := 0.0
+	for _, v := range H.counts {
+		if v == 0 {
+			continue
 		}
-
+		p := v / H.samples
+		ret -= p * math.Log(p)
 	}
-	return AF
+	return ret
 }
 
-//the only solution here seems to be to set up a 4D slice containing the frequencies for each combination of dihedral, angle1
-//and angle2. To normalize that and then transform to a 4D slice of energies, which is then used by the fitting function.
+//centers returns the center of the bin with the linear index index, for each dimension.
+func (H *JointHistogram) centers(index int) []float64 {
+	ret := make([]float64, len(H.nbins))
+	for i := len(H.nbins) - 1; i >= 0; i-- {
+		b := index % H.nbins[i]
+		index /= H.nbins[i]
+		ret[i] = H.lower[i] + (float64(b)+0.5)*H.width[i]
+	}
+	return ret
+}
 
-//takes a slice with values for 2 bendings and the torsion between them. From their relative abundance, obtains an energy
-//the first element in increments is the increment for the torsion, the second, for the 2 angles
-func IBoltzmannBT(inpt, inpb1, inpb2, incre []float64, temperature float64) ([]float64, []float64, []float64, []float64) {
-	bt := Newbendtor(len(inpb1))
-	copy(bt.b1, inpb1)
-	copy(bt.b2, inpb2)
-	copy(bt.tor, inpt)
-	sort.Float64s(inpb1)
-	sort.Float64s(inpb2)
-	sort.Float64s(inpt)
-	allFreqs := make([]*bendtorFreq, 0, 100)
-	for i := inpt[0]; i <= inpt[len(inpt)-1]+incre[0]; i += incre[0] {
-
-		for j := inpb1[0]; j <= inpb1[len(inpb1)-1]+incre[1]; j += incre[1] {
-
-			for k := inpb2[0]; k <= inpb2[len(inpb2)-1]+incre[2]; k += incre[2] {
-
-				freq := NewbendtorFreq()
-				freq.tor = []float64{i, i + incre[0]}
-				freq.b1 = []float64{j, j + incre[1]}
-				freq.b2 = []float64{k, k + incre[2]}
-				freq = CountAngles(freq, bt)
-				allFreqs = append(allFreqs, freq)
-
-			}
+//IBoltzmann inverts the Boltzmann distribution for the non-empty bins of the histogram, at the given temperature.
+//It returns the centers of the bins, as one slice per dimension, and the energies, in kJ/mol, with the most
+//populated bin at 0. The bins are returned in the order of their indexes, so the result is always the same
+//for the same data.
+func (H *JointHistogram) IBoltzmann(temperature float64) ([][]float64, []float64) {
+	indexes := make([]int, 0, len(H.counts))
+	largest := 0.0
+	for k, v := range H.counts {
+		indexes = append(indexes, k)
+		if v > largest {
+			largest = v
 		}
 	}
-	//now I need to define a type for a slice of bendtorFreq with a method that gives me the total/largest "frequencies" for the set of angles.
-	F := freqs(allFreqs)
-	largest := F.LargestFreq()
-	F = F.removeZeros()
-	for _, v := range F {
-		q := float64(v.n) / float64(largest)
-		v.e = -1 * chem.R * temperature * math.Log(q) //math.Log is the natural log
+	sort.Ints(indexes)
+	x := make([][]float64, len(H.nbins))
+	for i := range x {
+		x[i] = make([]float64, 0, len(indexes))
 	}
-	return F.tbbe()
+	E := make([]float64, 0, len(indexes))
+	for _, k := range indexes {
+		if H.counts[k] == 0 {
+			continue //can happen with weights.
+		}
+		for i, v := range H.centers(k) {
+			x[i] = append(x[i], v)
+		}
+		q := H.counts[k] / largest
+		E = append(E, -1*chem.R*temperature*math.Log(q)) //math.Log is the natural log
+	}
+	return x, E
+}
 
+//takes a slice with values for 2 bendings and the torsion between them. From their relative abundance, obtains an energy
+//the first element in increments is the increment for the torsion, the second and third, for the 2 angles.
+//It returns the torsions, first and second angles, and energies, for each non-empty bin.
+//weights, if not nil, are the weights for each sample, as in IBoltzmann.
+func IBoltzmannBT(inpt, inpb1, inpb2, incre []float64, temperature float64, weights []float64) ([]float64, []float64, []float64, []float64) {
+	H := NewJointHistogram([][]float64{inpt, inpb1, inpb2}, incre, weights)
+	x, E := H.IBoltzmann(temperature)
+	return x[0], x[1], x[2], E
 }
@@ -0,0 +1,192 @@
+/*
+ * uncertainty.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"gonum.org/v1/gonum/diff/fd"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+//The confidence level for the intervals reported for the parameters.
+const confidence float64 = 0.95
+
+//Covariance returns the covariance matrix for the parameters par, obtained by minimizing score (the sum of
+//the squared residues over twice the number of points, npoints) within the bounds B.
+//With H the Hessian of score at par, and s2=2*npoints*score/(npoints-len(par)) the variance of the residues,
+//the covariance is s2*inverse(npoints*H). Integer parameters are not free, so their
+//rows and columns are zero. The Hessian is obtained numerically, on parameters scaled to be of order 1, as
+//the force constants and the equilibrium values can differ by several orders of magnitude.
+func Covariance(score func([]float64) float64, par []float64, B *ParBounds, npoints int) (*mat.SymDense, error) {
+	dof := npoints - len(par)
+	if dof <= 0 {
+		return nil, fmt.Errorf("%d points are not enough to estimate the uncertainty of %d parameters", npoints, len(par))
+	}
+	free := make([]int, 0, len(par))
+	for i := range par {
+		if B == nil || !B.integer[i] {
+			free = append(free, i)
+		}
+	}
+	scale := make([]float64, len(free))
+	for i, v := range free {
+		scale[i] = math.Max(math.Abs(par[v]), 1e-2)
+	}
+	tmp := make([]float64, len(par))
+	scaled := func(s []float64) float64 {
+		copy(tmp, par)
+		for i, v := range free {
+			tmp[v] = s[i] * scale[i]
+		}
+		return score(tmp)
+	}
+	s0 := make([]float64, len(free))
+	for i := range s0 {
+		s0[i] = 1
+	}
+	hess := mat.NewSymDense(len(free), nil)
+	fd.Hessian(hess, scaled, s0, nil)
+	var chol mat.Cholesky
+	if ok := chol.Factorize(hess); !ok {
+		return nil, fmt.Errorf("the Hessian is not positive definite at the fitted parameters. Some parameters are probably redundant, or at their bounds")
+	}
+	inv := mat.NewSymDense(len(free), nil)
+	if err := chol.InverseTo(inv); err != nil {
+		return nil, err
+	}
+	s2 := 2 * float64(npoints) * score(par) / float64(dof)
+	cov := mat.NewSymDense(len(par), nil)
+	for i, v := range free {
+		for j, w := range free[i:] {
+			cov.SetSym(v, w, s2*inv.At(i, i+j)*scale[i]*scale[i+j]/float64(npoints))
+		}
+	}
+	return cov, nil
+}
+
+//SetUncertainties obtains, from the covariance for the internal-units parameters par, fitted by
+//minimizing score within the bounds B, the standard errors, the half-widths of the confidence intervals,
+//in GROMACS units, and the correlations for the parameters of b. b.npoints must be set.
+//If the uncertainties can't be obtained, b.uncerr is set to the reason, and the fit is still usable.
+func (b *bonded) SetUncertainties(score func([]float64) float64, par []float64, B *ParBounds) {
+	cov, err := Covariance(score, par, B, b.npoints)
+	if err != nil {
+		b.uncerr = err
+		return
+	}
+	n := len(par)
+	t := distuv.StudentsT{Mu: 0, Sigma: 1, Nu: float64(b.npoints - n)}.Quantile(0.5 + confidence/2)
+	sd := make([]float64, n)
+	for i := range sd {
+		sd[i] = math.Sqrt(math.Max(cov.At(i, i), 0))
+	}
+	b.corr = mat.NewSymDense(n, nil)
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			r := 0.0
+			if i == j {
+				r = 1
+			} else if sd[i] > 0 && sd[j] > 0 {
+				r = cov.At(i, j) / (sd[i] * sd[j])
+			}
+			b.corr.SetSym(i, j, r)
+		}
+	}
+	b.stderr = GromacsPar(b.pot, sd)
+	b.ci = make([]float64, n)
+	for i, v := range b.stderr {
+		b.ci[i] = t * v
+	}
+}
+
+//UncertaintyText returns the confidence intervals and the correlations for the parameters of b,
+//in GROMACS units, for the logs.
+func (b *bonded) UncertaintyText() string {
+	if b.uncerr != nil {
+		return "Uncertainties not available: " + b.uncerr.Error()
+	}
+	if b.ci == nil {
+		return ""
+	}
+	names := b.pot.ParNames()
+	units := b.pot.ParUnits()
+	ret := fmt.Sprintf("%2.0f%% confidence intervals:", confidence*100)
+	for i, v := range names {
+		ret += fmt.Sprintf(" %s: %.6g +/- %.3g %s", v, b.params[i], b.ci[i], units[i])
+	}
+	ret += " Correlations:"
+	for i := range names {
+		for j := i + 1; j < len(names); j++ {
+			ret += fmt.Sprintf(" %s-%s: %6.3f", names[i], names[j], b.corr.At(i, j))
+		}
+	}
+	return ret
+}
+
+//PrintUncertainties writes a tab-separated file with the parameters of every interaction in params, their standard
+//errors and confidence intervals (records starting with "par") and the correlations between each pair of
+//parameters (records starting with "corr"). Interactions whose fit failed, or that were not fitted, are not included.
+func PrintUncertainties(params map[string][]*bonded, outname string) {
+	fout, err := os.Create(outname)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer fout.Close()
+	fout.WriteString("# Parameter uncertainties by Bartender - www.github.com/rmera/bartender\n")
+	fout.WriteString(fmt.Sprintf("# par\tkind\tbeads\tpotential\tparameter\tunit\tvalue\tstderr\tci%2.0f_low\tci%2.0f_high\n", confidence*100, confidence*100))
+	fout.WriteString("# corr\tkind\tbeads\tpotential\tparameter1\tparameter2\tcorrelation\n")
+	for _, k := range []string{"bonds", "angles", "reb", "dihe", "improp"} {
+		for _, v := range params[k] {
+			if v.err != nil || v.built {
+				continue
+			}
+			beads := strings.TrimSpace(BeadsText(v.beads))
+			names := v.pot.ParNames()
+			units := v.pot.ParUnits()
+			for i, n := range names {
+				sd, ci := math.NaN(), math.NaN()
+				if v.ci != nil {
+					sd, ci = v.stderr[i], v.ci[i]
+				}
+				fout.WriteString(fmt.Sprintf("par\t%s\t%s\t%s\t%s\t%s\t%g\t%g\t%g\t%g\n", k, beads, v.pot.Name(), n, units[i], v.params[i], sd, v.params[i]-ci, v.params[i]+ci))
+			}
+			if v.corr == nil {
+				continue
+			}
+			for i := range names {
+				for j := i + 1; j < len(names); j++ {
+					fout.WriteString(fmt.Sprintf("corr\t%s\t%s\t%s\t%s\t%s\t%g\n", k, beads, v.pot.Name(), names[i], names[j], v.corr.At(i, j)))
+				}
+			}
+		}
+	}
+}
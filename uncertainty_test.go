@@ -0,0 +1,81 @@
+/*
+ * uncertainty_test.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+//TestCovarianceOLS compares the standard errors from Covariance for a straight line fit with the analytic,
+//ordinary least squares, ones.
+func TestCovarianceOLS(t *testing.T) {
+	n := 200
+	rng := rand.New(rand.NewSource(1))
+	x := make([]float64, n)
+	y := make([]float64, n)
+	var sx, sy, sxx, sxy float64
+	for i := range x {
+		x[i] = 10 * float64(i) / float64(n)
+		y[i] = 3 + 2*x[i] + rng.NormFloat64()
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		sxy += x[i] * y[i]
+	}
+	N := float64(n)
+	slope := (N*sxy - sx*sy) / (N*sxx - sx*sx)
+	intercept := (sy - slope*sx) / N
+	rss := 0.0
+	for i := range x {
+		r := y[i] - intercept - slope*x[i]
+		rss += r * r
+	}
+	s2 := rss / (N - 2)
+	sxxc := sxx - sx*sx/N
+	sdslope := math.Sqrt(s2 / sxxc)
+	sdintercept := math.Sqrt(s2 * (1/N + (sx/N)*(sx/N)/sxxc))
+	score := func(p []float64) float64 {
+		ret := 0.0
+		for i := range x {
+			r := y[i] - p[0] - p[1]*x[i]
+			ret += r * r
+		}
+		return ret / (2 * N)
+	}
+	cov, err := Covariance(score, []float64{intercept, slope}, nil, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []float64{sdintercept, sdslope} {
+		got := math.Sqrt(cov.At(i, i))
+		if math.Abs(got-want)/want > 1e-3 {
+			t.Errorf("Standard error of parameter %d: %g, expected %g", i, got, want)
+		}
+	}
+}
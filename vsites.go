@@ -0,0 +1,374 @@
+/*
+ * vsites.go, part of Bartender
+ *
+ *
+ * Copyright 2020 Raul Mera <rmera{at}usach(dot)cl>
+ *
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ *
+ *
+ */
+
+/*To the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	chem "github.com/rmera/gochem"
+	v3 "github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+//If a virtual site built from 3 beads can't be placed within this distance (A) of its bead (in the RMS sense) with the
+//in-plane construction, the out-of-plane one is tried.
+const vsitePlaneTol = 0.1
+
+//A virtual site: a bead whose position is not integrated, but obtained from the positions of other (constructing) beads.
+//Sites with 3 constructing beads are written to the [virtual_sites3] section, with function type 1 (in-plane, params a, b)
+//or 4 (out-of-plane, params a, b, c, with c in nm^-1). All the others are written to the [virtual_sitesn] section, as
+//centers of weights (function type 3), with one weight per constructing bead.
+type VirtualSite struct {
+	bead   int   //0-based
+	from   []int //0-based, the constructing beads
+	funct  int
+	params []float64
+	rmsd   float64 //of the bead positions obtained with the construction, in nm
+	frames int
+	err    error
+}
+
+//ParseInputVirtual returns the virtual sites declared in the BEADS section of the input file inpname. A bead is declared
+//virtual with the word "virtual" after its atoms, optionally followed by the (1-based, comma-separated) indexes of its constructing beads.
+//If they are not given, all the beads that are not virtual are used. nbeads is the number of beads in the mapping used, which may come from
+//a mapping file (see ReadMapping) instead of the BEADS section. In that case, the BEADS section must contain the same beads, or no virtual sites.
+func ParseInputVirtual(inpname string, nbeads int) []*VirtualSite {
+	finp, err := os.Open(inpname)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer finp.Close()
+	ret := make([]*VirtualSite, 0)
+	scanner := bufio.NewScanner(finp)
+	reading := false
+	declared := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "BEADS") {
+			reading = true
+			continue
+		}
+		if strings.HasPrefix(line, "BONDS") {
+			break
+		}
+		fields := strings.Fields(line)
+		if !reading || len(fields) < 2 {
+			continue
+		}
+		declared++
+		if len(fields) < 3 {
+			continue
+		}
+		if strings.ToLower(fields[2]) != "virtual" {
+			panic(fmt.Sprintf("Unknown bead option %s in: %s", fields[2], line))
+		}
+		vs := &VirtualSite{bead: declared - 1}
+		if len(fields) > 3 {
+			for _, v := range strings.Split(fields[3], ",") {
+				b, err := strconv.Atoi(v)
+				if err != nil {
+					panic(fmt.Sprintf("Malformed constructing beads for virtual bead %d: %s", declared, err.Error()))
+				}
+				vs.from = append(vs.from, b-1)
+			}
+		}
+		ret = append(ret, vs)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err.Error())
+	}
+	if len(ret) > 0 && declared != nbeads {
+		panic(fmt.Sprintf("The BEADS section of %s declares virtual sites, but has %d beads, and the mapping used has %d", inpname, declared, nbeads))
+	}
+	if err := setupVirtualSites(ret, nbeads); err != nil {
+		panic(err.Error())
+	}
+	return ret
+}
+
+//setupVirtualSites gives the default constructing beads to the virtual sites in vs that have none, and checks that
+//the constructing beads of each site exist and are not virtual themselves.
+func setupVirtualSites(vs []*VirtualSite, nbeads int) error {
+	virtual := make(map[int]bool)
+	for _, v := range vs {
+		virtual[v.bead] = true
+	}
+	for _, v := range vs {
+		if len(v.from) == 0 {
+			for i := 0; i < nbeads; i++ {
+				if !virtual[i] {
+					v.from = append(v.from, i)
+				}
+			}
+		}
+		if len(v.from) < 2 {
+			return fmt.Errorf("Virtual bead %d needs at least 2 constructing beads", v.bead+1)
+		}
+		for _, w := range v.from {
+			if w < 0 || w >= nbeads {
+				return fmt.Errorf("Virtual bead %d: constructing bead %d doesn't exist", v.bead+1, w+1)
+			}
+			if virtual[w] {
+				return fmt.Errorf("Virtual bead %d: constructing bead %d is also virtual", v.bead+1, w+1)
+			}
+		}
+		v.funct = 3
+		if len(v.from) == 3 {
+			v.funct = 1
+		}
+	}
+	return nil
+}
+
+//ExcludeVirtual removes, from the interactions in wanted and the marked ones, those involving virtual beads,
+//as the virtual sites are not subject to bonded interactions.
+func ExcludeVirtual(wanted map[string][][]int, marked [][]int, vs []*VirtualSite) (map[string][][]int, [][]int) {
+	if len(vs) == 0 {
+		return wanted, marked
+	}
+	virtual := func(beads []int) bool {
+		for _, v := range vs {
+			if containsInt(beads, v.bead) {
+				return true
+			}
+		}
+		return false
+	}
+	for k, v := range wanted {
+		if v == nil {
+			continue
+		}
+		kept := make([][]int, 0, len(v))
+		for _, w := range v {
+			if virtual(w) {
+				LogV(0, fmt.Sprintf("The %s between beads %s involves a virtual bead, and will not be fitted", CategoryName(k), BeadsText(w)))
+				continue
+			}
+			kept = append(kept, w)
+		}
+		wanted[k] = kept
+	}
+	var keptmarked [][]int
+	for _, w := range marked {
+		if !virtual(w) {
+			keptmarked = append(keptmarked, w)
+		}
+	}
+	return wanted, keptmarked
+}
+
+//BeadPositions returns the positions, in A, of the beads given by indexes and weights in every frame of traj.
+func BeadPositions(traj chem.Traj, mol chem.Atomer, indexes [][]int, weights [][]float64) ([][][3]float64, error) {
+	ret := make([][][3]float64, 0, 100)
+	coord := v3.Zeros(traj.Len())
+	var err error
+	for {
+		if err = traj.Next(coord); err != nil {
+			break
+		}
+		beads := make([][3]float64, len(indexes))
+		for j, v := range indexes {
+			c := WCOM(coord, mol, v, weights[j])
+			beads[j] = [3]float64{c.At(0, 0), c.At(0, 1), c.At(0, 2)}
+		}
+		ret = append(ret, beads)
+	}
+	if _, ok := err.(chem.LastFrameError); !ok {
+		return nil, err
+	}
+	return ret, nil
+}
+
+//Fit obtains the construction parameters of the virtual site that best reproduce the positions of its bead in the frames given
+//(see BeadPositions), by weighted least squares. If frameweights is nil, all frames have the same weight.
+func (vs *VirtualSite) Fit(frames [][][3]float64, frameweights []float64) {
+	vs.frames = len(frames)
+	if len(frames) == 0 {
+		vs.err = fmt.Errorf("No frames to fit")
+		return
+	}
+	if vs.funct == 1 {
+		vs.params, vs.rmsd, vs.err = vs.fitLinear(frames, frameweights, false)
+		if vs.err == nil && vs.rmsd > vsitePlaneTol {
+			p, rmsd, err := vs.fitLinear(frames, frameweights, true)
+			if err == nil && rmsd < vs.rmsd {
+				vs.funct = 4
+				vs.params, vs.rmsd = p, rmsd
+				vs.params[2] *= 10 //1/A to 1/nm
+			}
+		}
+	} else {
+		vs.params, vs.rmsd, vs.err = vs.fitLinear(frames, frameweights, false)
+		if vs.err == nil {
+			//The last weight is not fitted, as the weights add up to one.
+			vs.params = append(vs.params, 1-floats.Sum(vs.params))
+			for _, v := range vs.params {
+				if v < 0 {
+					LogV(0, fmt.Sprintf("The virtual site for bead %d has negative weights. Consider choosing other constructing beads", vs.bead+1))
+					break
+				}
+			}
+		}
+	}
+	vs.rmsd /= 10 //A to nm
+}
+
+//fitLinear solves the linear least squares problem for the construction parameters of the site. The position of the site, relative to
+//its last constructing bead (for centers of weights) or the first (for 3-bead sites), is a linear combination of the vectors from that bead
+//to the others (and, for 3-bead sites out of plane, of their cross product). It returns the parameters and the RMSD of the positions, in A.
+func (vs *VirtualSite) fitLinear(frames [][][3]float64, frameweights []float64, outofplane bool) ([]float64, float64, error) {
+	origin := vs.from[len(vs.from)-1]
+	others := vs.from[:len(vs.from)-1]
+	if vs.funct != 3 {
+		origin = vs.from[0]
+		others = vs.from[1:]
+	}
+	ncols := len(others)
+	if outofplane {
+		ncols++
+	}
+	A := mat.NewDense(3*len(frames), ncols, nil)
+	b := mat.NewVecDense(3*len(frames), nil)
+	w := make([]float64, len(frames))
+	for f, p := range frames {
+		w[f] = 1
+		if frameweights != nil {
+			w[f] = math.Sqrt(frameweights[f] * float64(len(frames)))
+		}
+		var cols [][3]float64
+		for _, o := range others {
+			cols = append(cols, sub3(p[o], p[origin]))
+		}
+		if outofplane {
+			cols = append(cols, cross3(cols[0], cols[1]))
+		}
+		for j := 0; j < 3; j++ {
+			for c, v := range cols {
+				A.Set(3*f+j, c, w[f]*v[j])
+			}
+			b.SetVec(3*f+j, w[f]*(p[vs.bead][j]-p[origin][j]))
+		}
+	}
+	var x mat.VecDense
+	if err := x.SolveVec(A, b); err != nil {
+		return nil, 0, err
+	}
+	var res mat.VecDense
+	res.MulVec(A, &x)
+	res.SubVec(&res, b)
+	norm := 0.0
+	for _, v := range w {
+		norm += v * v
+	}
+	rmsd := math.Sqrt(mat.Dot(&res, &res) / norm)
+	ret := make([]float64, ncols)
+	for i := range ret {
+		ret[i] = x.AtVec(i)
+	}
+	return ret, rmsd, nil
+}
+
+//Line returns the line for the virtual site in its itp section.
+func (vs *VirtualSite) Line() string {
+	if vs.err != nil {
+		return fmt.Sprintf(";; Fit of the virtual site for bead %d failed: %s\n", vs.bead+1, vs.err.Error())
+	}
+	note := fmt.Sprintf(" ; rmsd: %6.4f nm", vs.rmsd)
+	if vs.funct == 3 {
+		str := fmt.Sprintf("%3d   3  ", vs.bead+1)
+		for i, v := range vs.from {
+			str += fmt.Sprintf("  %3d %6.4f", v+1, vs.params[i])
+		}
+		return str + note + "\n"
+	}
+	str := fmt.Sprintf("%3d %3d %3d %3d   %d  ", vs.bead+1, vs.from[0]+1, vs.from[1]+1, vs.from[2]+1, vs.funct)
+	for _, v := range vs.params {
+		str += fmt.Sprintf(" %8.5f", v)
+	}
+	return str + note + "\n"
+}
+
+//FitVirtualSites fits the construction parameters of the virtual sites vs, using the mapped trajectory of run (or all the replicas in
+//its list, with the given frame weights).
+func FitVirtualSites(vs []*VirtualSite, run *MDOutput, mol chem.Atomer, indexes [][]int, weights [][]float64, frameweights []float64) error {
+	var frames [][][3]float64
+	if run.replicas != "" {
+		reps, err := ReadReplicaList(run.replicas)
+		if err != nil {
+			return err
+		}
+		for _, r := range reps {
+			_, traj, err := chem.XYZFileAsTraj(r.trajname)
+			if err != nil {
+				return err
+			}
+			f, err := BeadPositions(traj, mol, indexes, weights)
+			if err != nil {
+				return err
+			}
+			frames = append(frames, f...)
+		}
+	} else {
+		traj, err := run.Traj()
+		if err != nil {
+			return err
+		}
+		frames, err = BeadPositions(traj, mol, indexes, weights)
+		if err != nil {
+			return err
+		}
+	}
+	if frameweights != nil && len(frameweights) != len(frames) {
+		return fmt.Errorf("%d frames, but %d frame weights", len(frames), len(frameweights))
+	}
+	for _, v := range vs {
+		v.Fit(frames, frameweights)
+		if v.err != nil {
+			LogV(0, fmt.Sprintf("Couldn't fit the virtual site for bead %d: %s", v.bead+1, v.err.Error()))
+			continue
+		}
+		LogV(1, fmt.Sprintf("Virtual site for bead %d, from beads %s: function type %d, parameters %v, rmsd %6.4f nm", v.bead+1, BeadsText(v.from), v.funct, v.params, v.rmsd))
+	}
+	return nil
+}
+
+func sub3(a, b [3]float64) [3]float64 {
+	return [3]float64{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+}
+
+func cross3(a, b [3]float64) [3]float64 {
+	return [3]float64{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}